@@ -0,0 +1,288 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package adminapi holds the ProxyAdmin calls that are specific to this proxy
+// and not part of github.com/netclave/apis. The service is registered on the
+// same gRPC server as api.ProxyAdmin.
+//
+// The ProxyAdmin proto and its generated code live in github.com/netclave/apis,
+// which this repository only consumes. Until the calls are added there, the
+// messages are plain structs and the service description below is written by
+// hand in the shape protoc-gen-go would produce, so moving to the generated
+// client and server only changes imports.
+//
+// The calls use the "json" codec registered by this package instead of
+// protobuf. Clients select it with the content subtype, which puts
+// "application/grpc+json" on the wire, and NewProxyAdminClient does so for
+// every call. gRPC picks the codec per call, so the protobuf calls of
+// api.ProxyAdmin on the same server are unaffected. Message fields are encoded
+// with the lowerCamelCase names a proto3 JSON mapping would use, and methods
+// are named /adminapi.ProxyAdmin/<method>, for example
+// /adminapi.ProxyAdmin/listBans.
+package adminapi
+
+import (
+	"context"
+	"encoding/json"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+)
+
+// CODEC_NAME is the content subtype of the admin calls.
+const CODEC_NAME = "json"
+
+// jsonCodec marshals the admin messages with encoding/json.
+type jsonCodec struct {
+}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (jsonCodec) Name() string {
+	return CODEC_NAME
+}
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+}
+
+type Ban struct {
+	Ip        string `json:"ip"`
+	BannedAt  int64  `json:"bannedAt"`
+	ExpiresAt int64  `json:"expiresAt"`
+	Reason    string `json:"reason"`
+}
+
+type ListBansRequest struct {
+}
+
+type ListBansResponse struct {
+	Bans []*Ban `json:"bans"`
+}
+
+type BanAddressRequest struct {
+	Ip     string `json:"ip"`
+	Ttl    int64  `json:"ttl"`
+	Reason string `json:"reason"`
+}
+
+type BanAddressResponse struct {
+	Response string `json:"response"`
+}
+
+type UnbanAddressRequest struct {
+	Ip string `json:"ip"`
+}
+
+type UnbanAddressResponse struct {
+	Response string `json:"response"`
+}
+
+// IdentityProviderSyncStatus holds the sync state of an identity provider.
+// Times are in milliseconds since the epoch, zero when there was none yet,
+// and the backoff is in milliseconds.
+type IdentityProviderSyncStatus struct {
+	Id             string `json:"id"`
+	LastWalletSync int64  `json:"lastWalletSync"`
+	LastTokenSync  int64  `json:"lastTokenSync"`
+	LastError      string `json:"lastError"`
+	LastErrorAt    int64  `json:"lastErrorAt"`
+	Errors         int64  `json:"errors"`
+	Wallets        int64  `json:"wallets"`
+	ActiveTokens   int64  `json:"activeTokens"`
+	Backoff        int64  `json:"backoff"`
+	Stale          bool   `json:"stale"`
+}
+
+type SyncStatusRequest struct {
+}
+
+type SyncStatusResponse struct {
+	StalePolicy       string                        `json:"stalePolicy"`
+	StaleThreshold    int64                         `json:"staleThreshold"`
+	IdentityProviders []*IdentityProviderSyncStatus `json:"identityProviders"`
+}
+
+type ProxyAdminServer interface {
+	ListBans(context.Context, *ListBansRequest) (*ListBansResponse, error)
+	BanAddress(context.Context, *BanAddressRequest) (*BanAddressResponse, error)
+	UnbanAddress(context.Context, *UnbanAddressRequest) (*UnbanAddressResponse, error)
+	SyncStatus(context.Context, *SyncStatusRequest) (*SyncStatusResponse, error)
+}
+
+func RegisterProxyAdminServer(s *grpc.Server, srv ProxyAdminServer) {
+	s.RegisterService(&_ProxyAdmin_serviceDesc, srv)
+}
+
+func _ProxyAdmin_ListBans_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListBansRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProxyAdminServer).ListBans(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/adminapi.ProxyAdmin/listBans",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProxyAdminServer).ListBans(ctx, req.(*ListBansRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ProxyAdmin_BanAddress_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BanAddressRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProxyAdminServer).BanAddress(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/adminapi.ProxyAdmin/banAddress",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProxyAdminServer).BanAddress(ctx, req.(*BanAddressRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ProxyAdmin_UnbanAddress_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UnbanAddressRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProxyAdminServer).UnbanAddress(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/adminapi.ProxyAdmin/unbanAddress",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProxyAdminServer).UnbanAddress(ctx, req.(*UnbanAddressRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ProxyAdmin_SyncStatus_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SyncStatusRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ProxyAdminServer).SyncStatus(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/adminapi.ProxyAdmin/syncStatus",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ProxyAdminServer).SyncStatus(ctx, req.(*SyncStatusRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var _ProxyAdmin_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "adminapi.ProxyAdmin",
+	HandlerType: (*ProxyAdminServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "listBans",
+			Handler:    _ProxyAdmin_ListBans_Handler,
+		},
+		{
+			MethodName: "banAddress",
+			Handler:    _ProxyAdmin_BanAddress_Handler,
+		},
+		{
+			MethodName: "unbanAddress",
+			Handler:    _ProxyAdmin_UnbanAddress_Handler,
+		},
+		{
+			MethodName: "syncStatus",
+			Handler:    _ProxyAdmin_SyncStatus_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "adminapi/adminapi.go",
+}
+
+type ProxyAdminClient interface {
+	ListBans(ctx context.Context, in *ListBansRequest, opts ...grpc.CallOption) (*ListBansResponse, error)
+	BanAddress(ctx context.Context, in *BanAddressRequest, opts ...grpc.CallOption) (*BanAddressResponse, error)
+	UnbanAddress(ctx context.Context, in *UnbanAddressRequest, opts ...grpc.CallOption) (*UnbanAddressResponse, error)
+	SyncStatus(ctx context.Context, in *SyncStatusRequest, opts ...grpc.CallOption) (*SyncStatusResponse, error)
+}
+
+type proxyAdminClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewProxyAdminClient(cc grpc.ClientConnInterface) ProxyAdminClient {
+	return &proxyAdminClient{cc}
+}
+
+func (c *proxyAdminClient) invoke(ctx context.Context, method string, in interface{}, out interface{}, opts []grpc.CallOption) error {
+	opts = append([]grpc.CallOption{grpc.CallContentSubtype(CODEC_NAME)}, opts...)
+
+	return c.cc.Invoke(ctx, "/adminapi.ProxyAdmin/"+method, in, out, opts...)
+}
+
+func (c *proxyAdminClient) ListBans(ctx context.Context, in *ListBansRequest, opts ...grpc.CallOption) (*ListBansResponse, error) {
+	out := new(ListBansResponse)
+	err := c.invoke(ctx, "listBans", in, out, opts)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *proxyAdminClient) BanAddress(ctx context.Context, in *BanAddressRequest, opts ...grpc.CallOption) (*BanAddressResponse, error) {
+	out := new(BanAddressResponse)
+	err := c.invoke(ctx, "banAddress", in, out, opts)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *proxyAdminClient) UnbanAddress(ctx context.Context, in *UnbanAddressRequest, opts ...grpc.CallOption) (*UnbanAddressResponse, error) {
+	out := new(UnbanAddressResponse)
+	err := c.invoke(ctx, "unbanAddress", in, out, opts)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *proxyAdminClient) SyncStatus(ctx context.Context, in *SyncStatusRequest, opts ...grpc.CallOption) (*SyncStatusResponse, error) {
+	out := new(SyncStatusResponse)
+	err := c.invoke(ctx, "syncStatus", in, out, opts)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,320 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package balancer
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const ROUND_ROBIN = "roundrobin"
+const LEAST_CONNECTIONS = "leastconn"
+const WALLET_HASH = "wallethash"
+
+var ErrNoHealthyBackend = errors.New("No healthy backend")
+
+// HealthCheck describes the active check run against every backend of a pool.
+// A backend is ejected after UnhealthyThreshold consecutive failed checks and
+// admitted again after HealthyThreshold consecutive successful ones.
+type HealthCheck struct {
+	Path               string
+	Interval           time.Duration
+	Timeout            time.Duration
+	HealthyThreshold   int
+	UnhealthyThreshold int
+}
+
+type Backend struct {
+	URL *url.URL
+
+	connections  int64
+	unhealthy    int32
+	ejectedUntil int64
+	successes    int
+	failures     int
+}
+
+// Pool balances requests of a single proxy rule over its backends.
+type Pool struct {
+	Backends    []*Backend
+	Policy      string
+	HealthCheck *HealthCheck
+	EjectTime   time.Duration
+
+	next       uint64
+	ejectMutex sync.Mutex
+}
+
+func IsValidPolicy(policy string) bool {
+	switch policy {
+	case ROUND_ROBIN, LEAST_CONNECTIONS, WALLET_HASH:
+		return true
+	default:
+		return false
+	}
+}
+
+func NewPool(urls []*url.URL, policy string, healthCheck *HealthCheck, ejectTime time.Duration) (*Pool, error) {
+	if len(urls) == 0 {
+		return nil, errors.New("Pool without backends")
+	}
+
+	if policy == "" {
+		policy = ROUND_ROBIN
+	}
+
+	if IsValidPolicy(policy) == false {
+		return nil, errors.New("Unknown balancing policy: " + policy)
+	}
+
+	pool := &Pool{
+		Backends:    []*Backend{},
+		Policy:      policy,
+		HealthCheck: healthCheck,
+		EjectTime:   ejectTime,
+	}
+
+	for _, backendURL := range urls {
+		pool.Backends = append(pool.Backends, &Backend{
+			URL: backendURL,
+		})
+	}
+
+	return pool, nil
+}
+
+// Available reports whether the backend passes its health checks and is not
+// ejected after a connection error.
+func (b *Backend) Available() bool {
+	if atomic.LoadInt32(&b.unhealthy) == 1 {
+		return false
+	}
+
+	return time.Now().UnixNano() >= atomic.LoadInt64(&b.ejectedUntil)
+}
+
+func (b *Backend) Connections() int64 {
+	return atomic.LoadInt64(&b.connections)
+}
+
+// Acquire counts a request in flight to the backend, Release must be called
+// once it is finished.
+func (b *Backend) Acquire() {
+	atomic.AddInt64(&b.connections, 1)
+}
+
+func (b *Backend) Release() {
+	atomic.AddInt64(&b.connections, -1)
+}
+
+// Next picks a backend for a request. The key is only used by the wallet hash
+// policy, which sends all requests of a wallet to the same backend for as
+// long as it stays available.
+func (p *Pool) Next(key string) (*Backend, error) {
+	candidates := []*Backend{}
+
+	for _, backend := range p.Backends {
+		if backend.Available() {
+			candidates = append(candidates, backend)
+		}
+	}
+
+	if len(candidates) == 0 {
+		return nil, ErrNoHealthyBackend
+	}
+
+	switch p.Policy {
+	case LEAST_CONNECTIONS:
+		offset := int(atomic.AddUint64(&p.next, 1) % uint64(len(candidates)))
+		chosen := candidates[offset]
+
+		for i := 1; i < len(candidates); i++ {
+			candidate := candidates[(offset+i)%len(candidates)]
+
+			if candidate.Connections() < chosen.Connections() {
+				chosen = candidate
+			}
+		}
+
+		return chosen, nil
+	case WALLET_HASH:
+		if key != "" {
+			return highestRandomWeight(candidates, key), nil
+		}
+	}
+
+	index := atomic.AddUint64(&p.next, 1) % uint64(len(candidates))
+
+	return candidates[index], nil
+}
+
+// MarkFailed ejects a backend the reverse proxy could not connect to. It is
+// admitted again once EjectTime has passed. Other errors, such as timeouts
+// or connections reset by the upstream, do not eject, and neither does a
+// failure of the last available backend, so a single upstream that failed
+// once does not take the whole route down.
+func (p *Pool) MarkFailed(backend *Backend, err error) {
+	if p.EjectTime <= 0 || IsConnectError(err) == false {
+		return
+	}
+
+	p.ejectMutex.Lock()
+	defer p.ejectMutex.Unlock()
+
+	available := 0
+
+	for _, other := range p.Backends {
+		if other != backend && other.Available() {
+			available++
+		}
+	}
+
+	if available == 0 {
+		return
+	}
+
+	log.Println("Ejecting backend " + backend.URL.String() + " for " + p.EjectTime.String())
+
+	atomic.StoreInt64(&backend.ejectedUntil, time.Now().Add(p.EjectTime).UnixNano())
+}
+
+// IsConnectError reports whether the error is a failure to connect to the
+// backend.
+func IsConnectError(err error) bool {
+	var opErr *net.OpError
+
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// RunHealthChecks checks all backends every HealthCheck.Interval until the
+// context is cancelled. It returns immediately for pools without a check.
+func (p *Pool) RunHealthChecks(ctx context.Context, transport http.RoundTripper) {
+	if p.HealthCheck == nil {
+		return
+	}
+
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   p.HealthCheck.Timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	ticker := time.NewTicker(p.HealthCheck.Interval)
+	defer ticker.Stop()
+
+	for {
+		var wg sync.WaitGroup
+
+		for _, backend := range p.Backends {
+			wg.Add(1)
+
+			go func(backend *Backend) {
+				defer wg.Done()
+
+				p.checkBackend(ctx, client, backend)
+			}(backend)
+		}
+
+		wg.Wait()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Pool) checkBackend(ctx context.Context, client *http.Client, backend *Backend) {
+	checkURL := *backend.URL
+	checkURL.Path = strings.TrimSuffix(checkURL.Path, "/") + "/" + strings.TrimPrefix(p.HealthCheck.Path, "/")
+	checkURL.RawPath = ""
+
+	healthy := false
+
+	req, err := http.NewRequest("GET", checkURL.String(), nil)
+
+	if err == nil {
+		resp, err := client.Do(req.WithContext(ctx))
+
+		if err == nil {
+			resp.Body.Close()
+			healthy = resp.StatusCode >= 200 && resp.StatusCode < 400
+		}
+	}
+
+	if healthy == true {
+		backend.failures = 0
+		backend.successes++
+
+		if backend.successes >= p.HealthCheck.HealthyThreshold && atomic.CompareAndSwapInt32(&backend.unhealthy, 1, 0) {
+			log.Println("Backend " + backend.URL.String() + " is healthy again")
+		}
+
+		return
+	}
+
+	backend.successes = 0
+	backend.failures++
+
+	if backend.failures >= p.HealthCheck.UnhealthyThreshold && atomic.CompareAndSwapInt32(&backend.unhealthy, 0, 1) {
+		log.Println("Backend " + backend.URL.String() + " failed its health check")
+	}
+}
+
+func highestRandomWeight(candidates []*Backend, key string) *Backend {
+	var chosen *Backend
+	var chosenWeight uint64
+
+	for _, candidate := range candidates {
+		hash := fnv.New64a()
+		hash.Write([]byte(candidate.URL.String()))
+		hash.Write([]byte(key))
+
+		weight := mix(hash.Sum64())
+
+		if chosen == nil || weight > chosenWeight {
+			chosen = candidate
+			chosenWeight = weight
+		}
+	}
+
+	return chosen
+}
+
+// mix spreads the bits of an FNV hash. Without it backend URLs differing in
+// a single byte get correlated weights and most keys land on one backend.
+func mix(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+
+	return h
+}
@@ -0,0 +1,315 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package balancer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestPool(t *testing.T, policy string, ejectTime time.Duration, addresses ...string) *Pool {
+	t.Helper()
+
+	urls := []*url.URL{}
+
+	for _, address := range addresses {
+		u, err := url.Parse(address)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		urls = append(urls, u)
+	}
+
+	pool, err := NewPool(urls, policy, nil, ejectTime)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pool
+}
+
+func next(t *testing.T, pool *Pool, key string) *Backend {
+	t.Helper()
+
+	backend, err := pool.Next(key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return backend
+}
+
+var dialError = &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+
+func TestNewPool(t *testing.T) {
+	_, err := NewPool([]*url.URL{}, ROUND_ROBIN, nil, 0)
+
+	if err == nil {
+		t.Fatal("expected an error for a pool without backends")
+	}
+
+	_, err = NewPool([]*url.URL{{Scheme: "http", Host: "a"}}, "random", nil, 0)
+
+	if err == nil {
+		t.Fatal("expected an error for an unknown policy")
+	}
+
+	pool, err := NewPool([]*url.URL{{Scheme: "http", Host: "a"}}, "", nil, 0)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pool.Policy != ROUND_ROBIN {
+		t.Fatalf("default policy %q, expected %q", pool.Policy, ROUND_ROBIN)
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	pool := newTestPool(t, ROUND_ROBIN, 0, "http://a", "http://b", "http://c")
+
+	counts := map[string]int{}
+
+	for i := 0; i < 30; i++ {
+		counts[next(t, pool, "").URL.Host]++
+	}
+
+	for _, host := range []string{"a", "b", "c"} {
+		if counts[host] != 10 {
+			t.Fatalf("backend %s chosen %d times, expected 10: %v", host, counts[host], counts)
+		}
+	}
+}
+
+func TestLeastConnections(t *testing.T) {
+	pool := newTestPool(t, LEAST_CONNECTIONS, 0, "http://a", "http://b", "http://c")
+
+	pool.Backends[0].Acquire()
+	pool.Backends[0].Acquire()
+	pool.Backends[2].Acquire()
+
+	for i := 0; i < 5; i++ {
+		backend := next(t, pool, "")
+
+		if backend.URL.Host != "b" {
+			t.Fatalf("chose %s, expected the idle backend b", backend.URL.Host)
+		}
+	}
+
+	pool.Backends[1].Acquire()
+	pool.Backends[1].Acquire()
+	pool.Backends[0].Release()
+	pool.Backends[0].Release()
+
+	backend := next(t, pool, "")
+
+	if backend.URL.Host != "a" {
+		t.Fatalf("chose %s, expected a", backend.URL.Host)
+	}
+}
+
+func TestWalletHash(t *testing.T) {
+	pool := newTestPool(t, WALLET_HASH, time.Minute, "http://a", "http://b", "http://c")
+
+	chosen := map[string]*Backend{}
+	hosts := map[string]bool{}
+
+	for _, wallet := range []string{"w1", "w2", "w3", "w4", "w5", "w6", "w7", "w8"} {
+		chosen[wallet] = next(t, pool, wallet)
+		hosts[chosen[wallet].URL.Host] = true
+
+		for i := 0; i < 5; i++ {
+			if next(t, pool, wallet) != chosen[wallet] {
+				t.Fatalf("wallet %s moved to another backend", wallet)
+			}
+		}
+	}
+
+	if len(hosts) < 2 {
+		t.Fatalf("all wallets on %v", hosts)
+	}
+
+	// ejecting a backend only moves the wallets that were on it
+	ejected := chosen["w1"]
+	pool.MarkFailed(ejected, dialError)
+
+	for wallet, backend := range chosen {
+		moved := next(t, pool, wallet)
+
+		if backend == ejected && moved == ejected {
+			t.Fatalf("wallet %s still on the ejected backend", wallet)
+		}
+
+		if backend != ejected && moved != backend {
+			t.Fatalf("wallet %s moved although its backend is available", wallet)
+		}
+	}
+}
+
+func TestEjection(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		ejectTime time.Duration
+		ejected   bool
+	}{
+		{"dial error", dialError, time.Minute, true},
+		{"wrapped dial error", &url.Error{Op: "Get", URL: "http://a", Err: dialError}, time.Minute, true},
+		{"read error", &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}, time.Minute, false},
+		{"timeout", context.DeadlineExceeded, time.Minute, false},
+		{"ejection disabled", dialError, -1, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pool := newTestPool(t, ROUND_ROBIN, test.ejectTime, "http://a", "http://b")
+
+			pool.MarkFailed(pool.Backends[0], test.err)
+
+			if pool.Backends[0].Available() == test.ejected {
+				t.Fatalf("backend available %v, expected ejected %v", pool.Backends[0].Available(), test.ejected)
+			}
+		})
+	}
+}
+
+func TestEjectionKeepsLastBackend(t *testing.T) {
+	single := newTestPool(t, ROUND_ROBIN, time.Minute, "http://a")
+
+	single.MarkFailed(single.Backends[0], dialError)
+
+	if single.Backends[0].Available() == false {
+		t.Fatal("the only backend was ejected")
+	}
+
+	pool := newTestPool(t, ROUND_ROBIN, time.Minute, "http://a", "http://b")
+
+	pool.MarkFailed(pool.Backends[0], dialError)
+	pool.MarkFailed(pool.Backends[1], dialError)
+
+	if pool.Backends[1].Available() == false {
+		t.Fatal("the last available backend was ejected")
+	}
+
+	for i := 0; i < 4; i++ {
+		if next(t, pool, "").URL.Host != "b" {
+			t.Fatal("request sent to the ejected backend")
+		}
+	}
+}
+
+func TestEjectionExpires(t *testing.T) {
+	pool := newTestPool(t, ROUND_ROBIN, 50*time.Millisecond, "http://a", "http://b")
+
+	pool.MarkFailed(pool.Backends[0], dialError)
+
+	if pool.Backends[0].Available() == true {
+		t.Fatal("backend not ejected")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if pool.Backends[0].Available() == false {
+		t.Fatal("backend not admitted again after the eject time")
+	}
+}
+
+func TestHealthCheckThresholds(t *testing.T) {
+	var status int32 = http.StatusOK
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer server.Close()
+
+	pool := newTestPool(t, ROUND_ROBIN, 0, server.URL)
+	pool.HealthCheck = &HealthCheck{
+		Path:               "health",
+		Interval:           time.Second,
+		Timeout:            time.Second,
+		HealthyThreshold:   2,
+		UnhealthyThreshold: 3,
+	}
+
+	backend := pool.Backends[0]
+	client := server.Client()
+	ctx := context.Background()
+
+	atomic.StoreInt32(&status, http.StatusInternalServerError)
+
+	for i := 1; i <= 3; i++ {
+		pool.checkBackend(ctx, client, backend)
+
+		if backend.Available() != (i < 3) {
+			t.Fatalf("after %d failed checks available is %v", i, backend.Available())
+		}
+	}
+
+	_, err := pool.Next("")
+
+	if err != ErrNoHealthyBackend {
+		t.Fatalf("got %v, expected ErrNoHealthyBackend", err)
+	}
+
+	atomic.StoreInt32(&status, http.StatusOK)
+
+	pool.checkBackend(ctx, client, backend)
+
+	if backend.Available() == true {
+		t.Fatal("admitted after a single successful check")
+	}
+
+	pool.checkBackend(ctx, client, backend)
+
+	if backend.Available() == false {
+		t.Fatal("not admitted after two successful checks")
+	}
+
+	// a failure in between resets the count of successful checks
+	atomic.StoreInt32(&status, http.StatusInternalServerError)
+
+	pool.checkBackend(ctx, client, backend)
+	pool.checkBackend(ctx, client, backend)
+
+	atomic.StoreInt32(&status, http.StatusOK)
+
+	pool.checkBackend(ctx, client, backend)
+
+	atomic.StoreInt32(&status, http.StatusInternalServerError)
+
+	pool.checkBackend(ctx, client, backend)
+
+	if backend.Available() == false {
+		t.Fatal("ejected although the failures were not consecutive")
+	}
+}
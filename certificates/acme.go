@@ -0,0 +1,170 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package certificates
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/netclave/common/storage"
+	"github.com/netclave/proxy/config"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// StorageCache keeps ACME account keys, certificates and challenge tokens in
+// a GenericStorage table, so every proxy replica sharing the storage serves
+// the same certificates and can answer challenges started by the others.
+type StorageCache struct {
+	Storage *storage.GenericStorage
+	Table   string
+}
+
+func (sc *StorageCache) Get(ctx context.Context, key string) ([]byte, error) {
+	value, err := sc.Storage.GetKey(sc.Table, key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if value == "" {
+		return nil, autocert.ErrCacheMiss
+	}
+
+	return base64.StdEncoding.DecodeString(value)
+}
+
+func (sc *StorageCache) Put(ctx context.Context, key string, data []byte) error {
+	return sc.Storage.SetKey(sc.Table, key, base64.StdEncoding.EncodeToString(data), 0)
+}
+
+func (sc *StorageCache) Delete(ctx context.Context, key string) error {
+	_, err := sc.Storage.DelKey(sc.Table, key)
+
+	return err
+}
+
+// ACMEHosts returns the rule hosts certificates can be requested for: literal
+// host names, not patterns or IP addresses. A port in the rule is ignored.
+func ACMEHosts(rules []*config.HostRule) []string {
+	hosts := []string{}
+
+	for _, rule := range rules {
+		host := strings.ToLower(rule.Host)
+
+		splitHost, _, err := net.SplitHostPort(host)
+
+		if err == nil {
+			host = splitHost
+		}
+
+		if net.ParseIP(host) != nil || config.IsLiteralHost(host) == false {
+			continue
+		}
+
+		hosts = append(hosts, host)
+	}
+
+	return hosts
+}
+
+// NewACMEManager creates the autocert manager for the acme section of the
+// configuration. Only hosts returned by ACMEHosts for the current rules are
+// allowed, so a client can not make the proxy request arbitrary certificates.
+func NewACMEManager(cache autocert.Cache) (*autocert.Manager, error) {
+	httpClient := http.DefaultClient
+
+	if config.ACMECAFile != "" {
+		caCertificates, err := ioutil.ReadFile(config.ACMECAFile)
+
+		if err != nil {
+			return nil, err
+		}
+
+		rootCAs := x509.NewCertPool()
+
+		if rootCAs.AppendCertsFromPEM(caCertificates) == false {
+			return nil, errors.New("No certificates found in " + config.ACMECAFile)
+		}
+
+		httpClient = &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{RootCAs: rootCAs},
+			},
+		}
+	}
+
+	manager := &autocert.Manager{
+		Prompt: autocert.AcceptTOS,
+		Cache:  cache,
+		Email:  config.ACMEEmail,
+		Client: &acme.Client{
+			DirectoryURL: config.ACMEDirectoryURL,
+			HTTPClient:   httpClient,
+		},
+		HostPolicy: func(ctx context.Context, host string) error {
+			for _, allowed := range ACMEHosts(config.CurrentProxyRules()) {
+				if allowed == host {
+					return nil
+				}
+			}
+
+			return errors.New("No rule for host " + host)
+		},
+	}
+
+	return manager, nil
+}
+
+// ACMETLSConfig is TLSConfig with the TLS-ALPN-01 challenge protocol enabled.
+func ACMETLSConfig(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) *tls.Config {
+	tlsConfig := TLSConfig(getCertificate)
+	tlsConfig.NextProtos = append(tlsConfig.NextProtos, acme.ALPNProto)
+
+	return tlsConfig
+}
+
+// GetCertificate serves the configured certificate files first and falls
+// back to ACME for hosts they do not cover. TLS-ALPN-01 challenges always go
+// to the ACME manager.
+func GetCertificate(store *Store, manager *autocert.Manager) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if manager == nil {
+			return store.GetCertificate(hello)
+		}
+
+		for _, proto := range hello.SupportedProtos {
+			if proto == acme.ALPNProto {
+				return manager.GetCertificate(hello)
+			}
+		}
+
+		if hello.ServerName == "" || store.Has(strings.TrimSuffix(hello.ServerName, ".")) == true {
+			return store.GetCertificate(hello)
+		}
+
+		return manager.GetCertificate(hello)
+	}
+}
@@ -0,0 +1,204 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package certificates
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/netclave/common/storage"
+	"github.com/netclave/proxy/config"
+)
+
+func setRules(hosts ...string) {
+	rules := []*config.HostRule{}
+
+	for _, host := range hosts {
+		rules = append(rules, &config.HostRule{Host: host})
+	}
+
+	config.UpdateRoutes(rules, &config.RoutingTable{})
+}
+
+func TestACMEHosts(t *testing.T) {
+	setRules("Example.com", "www.example.com:8443", "^.*\\.example\\.com$", "127.0.0.1", "[::1]:443", "localhost")
+
+	hosts := ACMEHosts(config.CurrentProxyRules())
+	expected := []string{"example.com", "www.example.com", "localhost"}
+
+	if reflect.DeepEqual(hosts, expected) == false {
+		t.Fatalf("got %v, expected %v", hosts, expected)
+	}
+}
+
+func TestACMEHostPolicy(t *testing.T) {
+	config.ACMECAFile = ""
+
+	manager, err := NewACMEManager(nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setRules("app.example.com")
+
+	err = manager.HostPolicy(context.Background(), "app.example.com")
+
+	if err != nil {
+		t.Fatalf("rule host refused: %v", err)
+	}
+
+	err = manager.HostPolicy(context.Background(), "other.example.com")
+
+	if err == nil {
+		t.Fatal("host without a rule allowed")
+	}
+
+	// the policy follows reloaded rules
+	setRules("other.example.com")
+
+	err = manager.HostPolicy(context.Background(), "app.example.com")
+
+	if err == nil {
+		t.Fatal("host of a removed rule allowed")
+	}
+
+	err = manager.HostPolicy(context.Background(), "other.example.com")
+
+	if err != nil {
+		t.Fatalf("host of a new rule refused: %v", err)
+	}
+}
+
+// TestACMEPebble requests a certificate from a pebble test server, answering
+// the TLS-ALPN-01 challenge like the proxy does. It only runs when
+// NETCLAVE_PEBBLE_DIRECTORY is set, see README.md for the setup.
+//
+//	NETCLAVE_PEBBLE_DIRECTORY  directory URL, e.g. https://localhost:14000/dir
+//	NETCLAVE_PEBBLE_CA         CA of the directory, test/certs/pebble.minica.pem
+//	NETCLAVE_PEBBLE_HOST       host to request, must resolve to this machine
+//	                           for pebble, netclave.example.com by default
+//	NETCLAVE_PEBBLE_TLS        address pebble validates TLS-ALPN-01 on,
+//	                           :5001 by default
+func TestACMEPebble(t *testing.T) {
+	directoryURL := os.Getenv("NETCLAVE_PEBBLE_DIRECTORY")
+
+	if directoryURL == "" {
+		t.Skip("NETCLAVE_PEBBLE_DIRECTORY not set")
+	}
+
+	host := os.Getenv("NETCLAVE_PEBBLE_HOST")
+
+	if host == "" {
+		host = "netclave.example.com"
+	}
+
+	tlsAddress := os.Getenv("NETCLAVE_PEBBLE_TLS")
+
+	if tlsAddress == "" {
+		tlsAddress = ":5001"
+	}
+
+	config.ACMEDirectoryURL = directoryURL
+	config.ACMECAFile = os.Getenv("NETCLAVE_PEBBLE_CA")
+	config.ACMEEmail = "admin@" + host
+
+	setRules(host)
+
+	cacheStorage := &storage.GenericStorage{
+		Credentials: map[string]string{"filename": filepath.Join(t.TempDir(), "acme.db")},
+		StorageType: storage.SQLITE_STORAGE,
+	}
+
+	err := cacheStorage.Init()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache := &StorageCache{
+		Storage: cacheStorage,
+		Table:   "acmecache",
+	}
+
+	manager, err := NewACMEManager(cache)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := NewStore(nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", tlsAddress)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &http.Server{
+		Handler: http.NotFoundHandler(),
+	}
+
+	go server.Serve(tls.NewListener(listener, ACMETLSConfig(GetCertificate(store, manager))))
+	defer server.Close()
+
+	getCertificate := GetCertificate(store, manager)
+
+	_, err = getCertificate(&tls.ClientHelloInfo{ServerName: "other." + host})
+
+	if err == nil || strings.Contains(err.Error(), "No rule for host") == false {
+		t.Fatalf("certificate for a host without a rule: %v", err)
+	}
+
+	certificate, err := getCertificate(&tls.ClientHelloInfo{ServerName: host})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if leaf.VerifyHostname(host) != nil {
+		t.Fatalf("certificate for %v, expected %s", leaf.DNSNames, host)
+	}
+
+	keys, err := cacheStorage.GetKeys(cache.Table, "*")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(keys) == 0 {
+		t.Fatal("nothing stored in the ACME cache")
+	}
+}
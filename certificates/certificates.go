@@ -0,0 +1,232 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package certificates
+
+import (
+	"crypto/tls"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/netclave/proxy/config"
+)
+
+type entry struct {
+	hosts       []string
+	certFile    string
+	keyFile     string
+	certModTime time.Time
+	keyModTime  time.Time
+	certificate *tls.Certificate
+}
+
+// Store holds the certificates configured under host.certificates and picks
+// one per connection by SNI. Certificate files are reloaded when they change.
+type Store struct {
+	mutex   sync.RWMutex
+	entries []*entry
+}
+
+func NewStore(certificates []*config.CertificateConfig) (*Store, error) {
+	store := &Store{
+		entries: []*entry{},
+	}
+
+	for _, certificate := range certificates {
+		hosts := []string{}
+
+		for _, host := range certificate.Hosts {
+			hosts = append(hosts, strings.ToLower(host))
+		}
+
+		e := &entry{
+			hosts:    hosts,
+			certFile: certificate.CertFile,
+			keyFile:  certificate.KeyFile,
+		}
+
+		err := e.load()
+
+		if err != nil {
+			return nil, err
+		}
+
+		store.entries = append(store.entries, e)
+	}
+
+	return store, nil
+}
+
+func (e *entry) load() error {
+	certInfo, err := os.Stat(e.certFile)
+
+	if err != nil {
+		return err
+	}
+
+	keyInfo, err := os.Stat(e.keyFile)
+
+	if err != nil {
+		return err
+	}
+
+	certificate, err := tls.LoadX509KeyPair(e.certFile, e.keyFile)
+
+	if err != nil {
+		return err
+	}
+
+	e.certificate = &certificate
+	e.certModTime = certInfo.ModTime()
+	e.keyModTime = keyInfo.ModTime()
+
+	return nil
+}
+
+func (e *entry) changed() bool {
+	certInfo, err := os.Stat(e.certFile)
+
+	if err != nil {
+		return false
+	}
+
+	keyInfo, err := os.Stat(e.keyFile)
+
+	if err != nil {
+		return false
+	}
+
+	return !certInfo.ModTime().Equal(e.certModTime) || !keyInfo.ModTime().Equal(e.keyModTime)
+}
+
+// Reload loads the certificates whose files changed. A certificate that can
+// not be loaded, for example because only one of the files was replaced yet,
+// keeps being served until the next successful reload.
+func (s *Store) Reload() {
+	for _, e := range s.entries {
+		s.mutex.RLock()
+		changed := e.changed()
+		s.mutex.RUnlock()
+
+		if changed == false {
+			continue
+		}
+
+		reloaded := &entry{
+			hosts:    e.hosts,
+			certFile: e.certFile,
+			keyFile:  e.keyFile,
+		}
+
+		err := reloaded.load()
+
+		if err != nil {
+			log.Println("Can not reload certificate " + e.certFile + ": " + err.Error())
+			continue
+		}
+
+		s.mutex.Lock()
+		e.certificate = reloaded.certificate
+		e.certModTime = reloaded.certModTime
+		e.keyModTime = reloaded.keyModTime
+		s.mutex.Unlock()
+
+		log.Println("Reloaded certificate " + e.certFile)
+	}
+}
+
+// Has reports whether a certificate is configured for the host name.
+func (s *Store) Has(serverName string) bool {
+	return s.lookup(strings.ToLower(serverName)) != nil
+}
+
+// GetCertificate selects the certificate for the SNI server name. Exact host
+// names win over wildcards and the first configured certificate is the
+// default for clients that send no or an unknown server name.
+func (s *Store) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	e := s.lookup(strings.ToLower(strings.TrimSuffix(hello.ServerName, ".")))
+
+	if e == nil && len(s.entries) > 0 {
+		e = s.entries[0]
+	}
+
+	if e == nil {
+		return nil, errors.New("No certificate for " + hello.ServerName)
+	}
+
+	return e.certificate, nil
+}
+
+func (s *Store) lookup(serverName string) *entry {
+	if serverName == "" {
+		return nil
+	}
+
+	for _, e := range s.entries {
+		for _, host := range e.hosts {
+			if host == serverName {
+				return e
+			}
+		}
+	}
+
+	wildcard := ""
+
+	dot := strings.Index(serverName, ".")
+
+	if dot > 0 {
+		wildcard = "*" + serverName[dot:]
+	}
+
+	for _, e := range s.entries {
+		for _, host := range e.hosts {
+			if host == wildcard {
+				return e
+			}
+		}
+	}
+
+	return nil
+}
+
+// TLSConfig returns the server TLS settings used by the proxy: TLS 1.2 or
+// newer with forward secret AEAD cipher suites only.
+func TLSConfig(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) *tls.Config {
+	return &tls.Config{
+		GetCertificate: getCertificate,
+		MinVersion:     tls.VersionTLS12,
+		CurvePreferences: []tls.CurveID{
+			tls.X25519,
+			tls.CurveP256,
+		},
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+		},
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+}
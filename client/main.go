@@ -20,9 +20,12 @@ import (
 	"context"
 	"log"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	api "github.com/netclave/apis/proxy/api"
+	"github.com/netclave/proxy/adminapi"
 
 	"google.golang.org/grpc"
 )
@@ -137,6 +140,118 @@ func getActiveTokens(conn *grpc.ClientConn) {
 	}
 }
 
+func listBans(conn *grpc.ClientConn) {
+	client := adminapi.NewProxyAdminClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	in := &adminapi.ListBansRequest{}
+
+	response, err := client.ListBans(ctx, in)
+
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	for _, ban := range response.Bans {
+		expiresAt := "unknown"
+
+		if ban.ExpiresAt > 0 {
+			expiresAt = time.Unix(0, ban.ExpiresAt*int64(time.Millisecond)).Format(time.RFC3339)
+		}
+
+		log.Println(ban.Ip + " " + expiresAt + " " + ban.Reason)
+	}
+}
+
+func banAddress(conn *grpc.ClientConn, ip string, ttl int64, reason string) {
+	client := adminapi.NewProxyAdminClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	in := &adminapi.BanAddressRequest{
+		Ip:     ip,
+		Ttl:    ttl,
+		Reason: reason,
+	}
+
+	response, err := client.BanAddress(ctx, in)
+
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	log.Println(response.Response)
+}
+
+func unbanAddress(conn *grpc.ClientConn, ip string) {
+	client := adminapi.NewProxyAdminClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	in := &adminapi.UnbanAddressRequest{
+		Ip: ip,
+	}
+
+	response, err := client.UnbanAddress(ctx, in)
+
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	log.Println(response.Response)
+}
+
+func syncStatus(conn *grpc.ClientConn) {
+	client := adminapi.NewProxyAdminClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	in := &adminapi.SyncStatusRequest{}
+
+	response, err := client.SyncStatus(ctx, in)
+
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	log.Println("stale policy " + response.StalePolicy + ", threshold " + strconv.FormatInt(response.StaleThreshold, 10) + "s")
+
+	for _, status := range response.IdentityProviders {
+		state := "ok"
+
+		if status.Stale == true {
+			state = "stale"
+		}
+
+		log.Println(status.Id + " " + state +
+			" wallets " + strconv.FormatInt(status.Wallets, 10) + " synced " + formatMilliseconds(status.LastWalletSync) +
+			", tokens " + strconv.FormatInt(status.ActiveTokens, 10) + " synced " + formatMilliseconds(status.LastTokenSync) +
+			", errors " + strconv.FormatInt(status.Errors, 10) +
+			", backoff " + (time.Duration(status.Backoff) * time.Millisecond).String())
+
+		if status.LastError != "" {
+			log.Println("  last error at " + formatMilliseconds(status.LastErrorAt) + ": " + status.LastError)
+		}
+	}
+}
+
+func formatMilliseconds(milliseconds int64) string {
+	if milliseconds == 0 {
+		return "never"
+	}
+
+	return time.Unix(0, milliseconds*int64(time.Millisecond)).Format(time.RFC3339)
+}
+
 func main() {
 	if len(os.Args) == 1 || len(os.Args) == 2 {
 		log.Println("client url addIdentityProvider identityProviderUrl emailOrPhone")
@@ -144,6 +259,10 @@ func main() {
 		log.Println("client url listIdentityProviders")
 		log.Println("client url getWalletsAndServices")
 		log.Println("client url getActiveTokens")
+		log.Println("client url listBans")
+		log.Println("client url banAddress ip [ttlInMilliseconds] [reason]")
+		log.Println("client url unbanAddress ip")
+		log.Println("client url syncStatus")
 
 		return
 	}
@@ -177,6 +296,37 @@ func main() {
 		{
 			getActiveTokens(conn)
 		}
+	case "listBans":
+		{
+			listBans(conn)
+		}
+	case "banAddress":
+		{
+			ttl := int64(0)
+			reason := ""
+
+			if len(os.Args) > 4 {
+				ttl, err = strconv.ParseInt(os.Args[4], 10, 64)
+
+				if err != nil {
+					log.Fatalf("invalid ttl: %s", err)
+				}
+			}
+
+			if len(os.Args) > 5 {
+				reason = strings.Join(os.Args[5:], " ")
+			}
+
+			banAddress(conn, os.Args[3], ttl, reason)
+		}
+	case "unbanAddress":
+		{
+			unbanAddress(conn, os.Args[3])
+		}
+	case "syncStatus":
+		{
+			syncStatus(conn)
+		}
 	default:
 		{
 			log.Println("You have to choose program")
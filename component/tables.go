@@ -18,3 +18,10 @@ package component
 
 var TOKENS = "tokens"
 var SERVICES = "services"
+var QUERY_TOKENS = "querytokens"
+var FAIL2BAN_FAILURES = "fail2banfailures"
+var FAIL2BAN_BANS = "fail2banbans"
+var ACME_CACHE = "acmecache"
+var IP_SESSIONS = "ipsessions"
+var PUSH_NONCES = "pushnonces"
+var WALLET_KEYS = "walletkeys"
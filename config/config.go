@@ -18,14 +18,21 @@ package config
 
 import (
 	"bufio"
+	"errors"
 	"flag"
+	"fmt"
+	"html/template"
 	"log"
+	"net"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/fsnotify/fsnotify"
+	"github.com/netclave/common/storage"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
-	"github.com/netclave/common/storage"
 )
 
 var DataStorageCredentials map[string]string
@@ -34,15 +41,103 @@ var StorageType string
 var Fail2BanDataStorageCredentials map[string]string
 var Fail2BanStorageType string
 var Fail2BanTTL int64
+var Fail2BanMaxFailures int64
+var Fail2BanFindTime int64
+var Fail2BanStatusCode int
+var Fail2BanAllowList []*net.IPNet
+var Fail2BanDenyList []*net.IPNet
+var TrustedProxies []*net.IPNet
 
 var TokenTTL = time.Duration(300)
 
+const ERROR_PAGE_AUTO = "auto"
+const ERROR_PAGE_HTML = "html"
+const ERROR_PAGE_JSON = "json"
+
+var ErrorPageFormat = ERROR_PAGE_AUTO
+var ErrorPageTemplate *template.Template
+var WalletURL = ""
+
+var AcceptAuthorizationHeader = true
+var AcceptQueryParameter = false
+
+var IdentityHeaderWallet = "X-NetClave-Wallet"
+var IdentityHeaderIdentityProvider = "X-NetClave-IdP"
+var IdentityHeaderJWT = ""
+var IdentityJWTTTL = int64(60)
+
+var TransportDialTimeout = int64(30)
+var TransportKeepAlive = int64(30)
+var TransportTLSHandshakeTimeout = int64(10)
+var TransportResponseHeaderTimeout = int64(0)
+var TransportIdleConnTimeout = int64(90)
+var TransportMaxIdleConns = 100
+var TransportMaxIdleConnsPerHost = 32
+var TransportMaxConnsPerHost = 0
+var TransportHTTP2 = true
+
+var WebSocketIdleTimeout = int64(0)
+var WebSocketMaxLifetime = int64(0)
+
+var IPSessionTTL = int64(300)
+var TCPProxies []*TCPProxyRule
+
+var ShutdownTimeout = int64(30)
+var UpgradeTimeout = int64(30)
+
 var ListenProxyAddress = ":9998"
+var ListenProxyTLSAddress = ""
+var H2C = false
+var RedirectHTTP = false
+var Certificates []*CertificateConfig
+var CertificatesReloadInterval = int64(10)
 var ListenGRPCAddress = "localhost:6664"
-var ProxyRules map[string][]map[string]string
+var ListenPushAddress = ""
+
+const STALE_FAIL_OPEN = "failopen"
+const STALE_FAIL_CLOSED = "failclosed"
+
+var SyncInterval = int64(2)
+var SyncReconcileInterval = int64(60)
+var PushMaxAge = int64(60)
+var SyncMaxBackoff = int64(300)
+var SyncStalePolicy = STALE_FAIL_OPEN
+var SyncStaleThreshold = int64(0)
+
+var ACMEEnabled = false
+var ACMEEmail = ""
+var ACMEDirectoryURL = ""
+var ACMECAFile = ""
+var ConfigFile = ""
+var ProxyRules []*HostRule
+var Routes *RoutingTable
+
+var routesMutex sync.RWMutex
+
+// CertificateConfig is a certificate served by the TLS listener for Hosts,
+// which may contain wildcards like *.example.com.
+type CertificateConfig struct {
+	Hosts    []string
+	CertFile string
+	KeyFile  string
+}
+
+// TCPProxyRule forwards raw connections accepted on Listen to Upstream while
+// the client address has an IP session granting access to Service, the name
+// matched against the wallet's services like an HTTP host. Clients must
+// connect to Listen directly, the PROXY protocol is not supported, so behind
+// a load balancer no connection matches a session. IdleTimeout and
+// MaxLifetime are in seconds, 0 disables them.
+type TCPProxyRule struct {
+	Listen      string
+	Upstream    string
+	Service     string
+	IdleTimeout int64
+	MaxLifetime int64
+}
 
 func Init() error {
-	ProxyRules = map[string][]map[string]string{}
+	ProxyRules = []*HostRule{}
 
 	flag.String("configFile", "/opt/config.json", "Provide full path to your config json file")
 
@@ -54,6 +149,11 @@ func Init() error {
 
 	file, err := os.Open(filename)
 
+	if err == nil {
+		ConfigFile = filename
+		defer file.Close()
+	}
+
 	viper.SetConfigType("json")
 
 	if err != nil {
@@ -69,6 +169,11 @@ func Init() error {
 
 	viper.SetDefault("host.httpaddress", ":9998")
 	viper.SetDefault("host.grpcaddress", "localhost:6664")
+	viper.SetDefault("host.httpsaddress", "")
+	viper.SetDefault("host.redirecthttp", false)
+	viper.SetDefault("host.h2c", false)
+	viper.SetDefault("host.pushaddress", "")
+	viper.SetDefault("host.certificatesreloadinterval", int64(10))
 
 	viper.SetDefault("datastorage.credentials", map[string]string{
 		"host":     "localhost:6379",
@@ -85,11 +190,78 @@ func Init() error {
 	viper.SetDefault("fail2bandatastorage.type", storage.REDIS_STORAGE)
 
 	viper.SetDefault("fail2banttl", int64(300000))
+	viper.SetDefault("fail2banmaxfailures", int64(5))
+	viper.SetDefault("fail2banfindtime", int64(60000))
+	viper.SetDefault("fail2banstatuscode", 403)
 
 	hostConfig := viper.Sub("host")
 
 	ListenProxyAddress = hostConfig.GetString("httpaddress")
 	ListenGRPCAddress = hostConfig.GetString("grpcaddress")
+	ListenProxyTLSAddress = viper.GetString("host.httpsaddress")
+	RedirectHTTP = viper.GetBool("host.redirecthttp")
+	H2C = viper.GetBool("host.h2c")
+	ListenPushAddress = viper.GetString("host.pushaddress")
+
+	viper.SetDefault("sync.interval", int64(2))
+	viper.SetDefault("sync.reconcileinterval", int64(60))
+	viper.SetDefault("sync.pushmaxage", int64(60))
+	viper.SetDefault("sync.maxbackoff", int64(300))
+	viper.SetDefault("sync.stalepolicy", STALE_FAIL_OPEN)
+	viper.SetDefault("sync.stalethreshold", int64(0))
+
+	SyncInterval = viper.GetInt64("sync.interval")
+	SyncReconcileInterval = viper.GetInt64("sync.reconcileinterval")
+	PushMaxAge = viper.GetInt64("sync.pushmaxage")
+	SyncMaxBackoff = viper.GetInt64("sync.maxbackoff")
+	SyncStalePolicy = viper.GetString("sync.stalepolicy")
+	SyncStaleThreshold = viper.GetInt64("sync.stalethreshold")
+
+	if SyncInterval <= 0 || SyncReconcileInterval <= 0 {
+		return errors.New("sync intervals must be positive")
+	}
+
+	// stored tokens are renewed by the syncs once half of their TTL passed
+	if SyncInterval >= int64(TokenTTL)/2 || SyncReconcileInterval >= int64(TokenTTL)/2 {
+		return fmt.Errorf("sync intervals must be shorter than %d seconds, half of the token TTL", int64(TokenTTL)/2)
+	}
+
+	if SyncStalePolicy != STALE_FAIL_OPEN && SyncStalePolicy != STALE_FAIL_CLOSED {
+		return errors.New("sync.stalepolicy must be " + STALE_FAIL_OPEN + " or " + STALE_FAIL_CLOSED)
+	}
+
+	CertificatesReloadInterval = viper.GetInt64("host.certificatesreloadinterval")
+
+	Certificates = []*CertificateConfig{}
+
+	err = viper.UnmarshalKey("host.certificates", &Certificates)
+
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+
+	viper.SetDefault("acme.enabled", false)
+	viper.SetDefault("acme.email", "")
+	viper.SetDefault("acme.directoryurl", "https://acme-v02.api.letsencrypt.org/directory")
+	viper.SetDefault("acme.cafile", "")
+
+	ACMEEnabled = viper.GetBool("acme.enabled")
+	ACMEEmail = viper.GetString("acme.email")
+	ACMEDirectoryURL = viper.GetString("acme.directoryurl")
+	ACMECAFile = viper.GetString("acme.cafile")
+
+	if ACMEEnabled == true && ListenProxyTLSAddress == "" {
+		return errors.New("acme.enabled requires host.httpsaddress")
+	}
+
+	if ListenProxyTLSAddress != "" && len(Certificates) == 0 && ACMEEnabled == false {
+		return errors.New("host.httpsaddress requires host.certificates or acme.enabled")
+	}
+
+	if CertificatesReloadInterval <= 0 {
+		CertificatesReloadInterval = 10
+	}
 
 	log.Println(ListenProxyAddress)
 	log.Println(ListenGRPCAddress)
@@ -105,29 +277,254 @@ func Init() error {
 	Fail2BanStorageType = fail2banDatastorageConfig.GetString("type")
 
 	Fail2BanTTL = viper.GetInt64("fail2banttl")
+	Fail2BanMaxFailures = viper.GetInt64("fail2banmaxfailures")
+	Fail2BanFindTime = viper.GetInt64("fail2banfindtime")
+	Fail2BanStatusCode = viper.GetInt("fail2banstatuscode")
 
-	hostsKeys := viper.GetStringMap("rules")
+	if Fail2BanStatusCode < 400 || Fail2BanStatusCode > 599 {
+		return fmt.Errorf("fail2banstatuscode must be an HTTP error status, got %d", Fail2BanStatusCode)
+	}
 
-	for hostKey := range hostsKeys {
-		log.Println(hostKey)
+	Fail2BanAllowList, err = ParseNetworks(viper.GetStringSlice("fail2banallowlist"))
 
-		var rules []map[string]string
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+
+	Fail2BanDenyList, err = ParseNetworks(viper.GetStringSlice("fail2bandenylist"))
+
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+
+	viper.SetDefault("credentials.authorizationheader", true)
+	viper.SetDefault("credentials.queryparameter", false)
+
+	AcceptAuthorizationHeader = viper.GetBool("credentials.authorizationheader")
+	AcceptQueryParameter = viper.GetBool("credentials.queryparameter")
+
+	viper.SetDefault("identityheaders.wallet", "X-NetClave-Wallet")
+	viper.SetDefault("identityheaders.identityprovider", "X-NetClave-IdP")
+	viper.SetDefault("identityheaders.jwt", "")
+	viper.SetDefault("identityheaders.jwtttl", int64(60))
+
+	IdentityHeaderWallet = viper.GetString("identityheaders.wallet")
+	IdentityHeaderIdentityProvider = viper.GetString("identityheaders.identityprovider")
+	IdentityHeaderJWT = viper.GetString("identityheaders.jwt")
+	IdentityJWTTTL = viper.GetInt64("identityheaders.jwtttl")
+
+	viper.SetDefault("errorpage.format", ERROR_PAGE_AUTO)
+
+	ErrorPageFormat = viper.GetString("errorpage.format")
+
+	if ErrorPageFormat != ERROR_PAGE_AUTO && ErrorPageFormat != ERROR_PAGE_HTML && ErrorPageFormat != ERROR_PAGE_JSON {
+		return fmt.Errorf("errorpage.format must be one of auto, html or json, got %q", ErrorPageFormat)
+	}
+
+	WalletURL = viper.GetString("errorpage.walleturl")
+
+	errorPageTemplateFile := viper.GetString("errorpage.template")
 
-		err = viper.UnmarshalKey("rules."+hostKey, &rules)
+	if errorPageTemplateFile != "" {
+		ErrorPageTemplate, err = template.ParseFiles(errorPageTemplateFile)
 
 		if err != nil {
 			log.Println(err.Error())
 			return err
 		}
+	}
 
-		ProxyRules[hostKey] = rules
+	TrustedProxies, err = ParseNetworks(viper.GetStringSlice("trustedproxies"))
 
-		for _, rule := range rules {
-			for from, to := range rule {
-				log.Println(hostKey + from + " ---> " + to)
-			}
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+
+	viper.SetDefault("transport.dialtimeout", int64(30))
+	viper.SetDefault("transport.keepalive", int64(30))
+	viper.SetDefault("transport.tlshandshaketimeout", int64(10))
+	viper.SetDefault("transport.responseheadertimeout", int64(0))
+	viper.SetDefault("transport.idleconntimeout", int64(90))
+	viper.SetDefault("transport.maxidleconns", 100)
+	viper.SetDefault("transport.maxidleconnsperhost", 32)
+	viper.SetDefault("transport.maxconnsperhost", 0)
+	viper.SetDefault("transport.http2", true)
+
+	TransportDialTimeout = viper.GetInt64("transport.dialtimeout")
+	TransportKeepAlive = viper.GetInt64("transport.keepalive")
+	TransportTLSHandshakeTimeout = viper.GetInt64("transport.tlshandshaketimeout")
+	TransportResponseHeaderTimeout = viper.GetInt64("transport.responseheadertimeout")
+	TransportIdleConnTimeout = viper.GetInt64("transport.idleconntimeout")
+	TransportMaxIdleConns = viper.GetInt("transport.maxidleconns")
+	TransportMaxIdleConnsPerHost = viper.GetInt("transport.maxidleconnsperhost")
+	TransportMaxConnsPerHost = viper.GetInt("transport.maxconnsperhost")
+	TransportHTTP2 = viper.GetBool("transport.http2")
+
+	viper.SetDefault("websocket.idletimeout", int64(0))
+	viper.SetDefault("websocket.maxlifetime", int64(0))
+
+	WebSocketIdleTimeout = viper.GetInt64("websocket.idletimeout")
+	WebSocketMaxLifetime = viper.GetInt64("websocket.maxlifetime")
+
+	viper.SetDefault("shutdowntimeout", int64(30))
+
+	ShutdownTimeout = viper.GetInt64("shutdowntimeout")
+
+	viper.SetDefault("upgradetimeout", int64(30))
+
+	UpgradeTimeout = viper.GetInt64("upgradetimeout")
+
+	viper.SetDefault("ipsessionttl", int64(300))
+
+	IPSessionTTL = viper.GetInt64("ipsessionttl")
+
+	TCPProxies = []*TCPProxyRule{}
+
+	err = viper.UnmarshalKey("tcp", &TCPProxies)
+
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+
+	for _, tcpProxy := range TCPProxies {
+		if tcpProxy.Listen == "" || tcpProxy.Upstream == "" || tcpProxy.Service == "" {
+			return errors.New("tcp proxies need listen, upstream and service")
 		}
+
+		log.Println(tcpProxy.Listen + " ---> " + tcpProxy.Upstream + " (" + tcpProxy.Service + ")")
+	}
+
+	ProxyRules, err = parseProxyRules(viper.Get("rules"))
+
+	if err != nil {
+		log.Println(err.Error())
+		return err
 	}
 
+	Routes, err = CompileRoutingTable(ProxyRules)
+
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+
+	logRoutes(Routes)
+
 	return nil
 }
+
+func logRoutes(routes *RoutingTable) {
+	for _, hostRoute := range routes.Hosts {
+		for _, pathRoute := range hostRoute.Paths {
+			for _, backend := range pathRoute.Pool.Backends {
+				log.Println(hostRoute.Host + pathRoute.Path + " ---> " + backend.URL.String())
+			}
+		}
+	}
+}
+
+// LoadRoutes reads the rules from the configuration file again and compiles
+// them. Only the rules are read, other settings keep their startup values.
+func LoadRoutes() ([]*HostRule, *RoutingTable, error) {
+	if ConfigFile == "" {
+		return nil, nil, errors.New("No configuration file to reload")
+	}
+
+	file, err := os.Open(ConfigFile)
+
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	fileConfig := viper.New()
+	fileConfig.SetConfigType("json")
+
+	err = fileConfig.ReadConfig(bufio.NewReader(file))
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rules, err := parseProxyRules(fileConfig.Get("rules"))
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	routes, err := CompileRoutingTable(rules)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	logRoutes(routes)
+
+	return rules, routes, nil
+}
+
+// UpdateRoutes replaces ProxyRules and Routes after a reload.
+func UpdateRoutes(rules []*HostRule, routes *RoutingTable) {
+	routesMutex.Lock()
+	defer routesMutex.Unlock()
+
+	ProxyRules = rules
+	Routes = routes
+}
+
+// CurrentProxyRules returns ProxyRules, safe to call while rules are reloaded.
+func CurrentProxyRules() []*HostRule {
+	routesMutex.RLock()
+	defer routesMutex.RUnlock()
+
+	return ProxyRules
+}
+
+// WatchConfigFile calls onChange whenever the configuration file changes.
+func WatchConfigFile(onChange func()) {
+	if ConfigFile == "" {
+		return
+	}
+
+	viper.SetConfigFile(ConfigFile)
+	viper.OnConfigChange(func(event fsnotify.Event) {
+		onChange()
+	})
+	viper.WatchConfig()
+}
+
+// ParseNetworks parses a list of CIDR ranges, a plain IP address is taken as
+// a range holding just that address.
+func ParseNetworks(entries []string) ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", entry)
+			}
+
+			if ip.To4() != nil {
+				entry = entry + "/32"
+			} else {
+				entry = entry + "/128"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+
+		if err != nil {
+			return nil, err
+		}
+
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
@@ -0,0 +1,97 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseNetworks(t *testing.T) {
+	tests := []struct {
+		name     string
+		entries  []string
+		expected []string
+		fails    bool
+	}{
+		{"empty", []string{}, []string{}, false},
+		{"CIDR ranges", []string{"10.0.0.0/8", "fd00::/8"}, []string{"10.0.0.0/8", "fd00::/8"}, false},
+		{"CIDR normalised", []string{"192.168.1.7/24"}, []string{"192.168.1.0/24"}, false},
+		{"plain IPv4", []string{"192.0.2.1"}, []string{"192.0.2.1/32"}, false},
+		{"plain IPv6", []string{"2001:db8::1"}, []string{"2001:db8::1/128"}, false},
+		{"invalid prefix length", []string{"10.0.0.0/33"}, nil, true},
+		{"invalid CIDR address", []string{"10.0.0.300/8"}, nil, true},
+		{"invalid IP", []string{"10.0.0.300"}, nil, true},
+		{"host name", []string{"localhost"}, nil, true},
+		{"invalid after valid", []string{"10.0.0.0/8", "nonsense/8"}, nil, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			networks, err := ParseNetworks(test.entries)
+
+			if test.fails == true {
+				if err == nil {
+					t.Fatalf("parsed %v", networks)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			result := []string{}
+
+			for _, network := range networks {
+				result = append(result, network.String())
+			}
+
+			if strings.Join(result, " ") != strings.Join(test.expected, " ") {
+				t.Fatalf("got %v, expected %v", result, test.expected)
+			}
+		})
+	}
+}
+
+// TestInitRejectsInvalidNetworks runs Init, which can only be called once per
+// process, with an invalid fail2ban allowlist.
+func TestInitRejectsInvalidNetworks(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.json")
+
+	err := ioutil.WriteFile(configFile, []byte(`{"fail2banallowlist": ["10.0.0.0/33"]}`), 0600)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(args []string) {
+		os.Args = args
+	}(os.Args)
+
+	os.Args = []string{os.Args[0], "--configFile", configFile}
+
+	err = Init()
+
+	if err == nil || strings.Contains(err.Error(), "10.0.0.0/33") == false {
+		t.Fatalf("invalid allowlist accepted: %v", err)
+	}
+}
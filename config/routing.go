@@ -0,0 +1,401 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package config
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/netclave/proxy/balancer"
+	"golang.org/x/net/http2"
+)
+
+const PROTOCOL_HTTP = "http"
+const PROTOCOL_H2C = "h2c"
+
+// RoutingTable is the compiled form of ProxyRules. Every pattern is compiled
+// once at startup, so serving a request never compiles a regular expression.
+type RoutingTable struct {
+	Hosts  []*HostRoute
+	Dialer *net.Dialer
+}
+
+// HostRoute matches hosts that are literal names or IP addresses exactly,
+// other hosts are regular expressions matched against the whole request host
+// without its port.
+type HostRoute struct {
+	Host     string
+	Priority int
+	Literal  bool
+	Matcher  *regexp.Regexp
+	Paths    []*PathRoute
+}
+
+var hostnamePattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?(\.[a-z0-9]([a-z0-9-]*[a-z0-9])?)*$`)
+
+// IsLiteralHost reports whether a rule host is a host name or an IP address,
+// with or without a port, rather than a regular expression.
+func IsLiteralHost(host string) bool {
+	host = strings.ToLower(host)
+
+	splitHost, _, err := net.SplitHostPort(host)
+
+	if err == nil {
+		host = splitHost
+	}
+
+	return net.ParseIP(host) != nil || hostnamePattern.MatchString(host)
+}
+
+type PathRoute struct {
+	Path          string
+	Matcher       *regexp.Regexp
+	Pool          *balancer.Pool
+	TLSConfig     *tls.Config
+	Dialer        *net.Dialer
+	Transport     http.RoundTripper
+	FlushInterval time.Duration
+	StripPrefix   bool
+	Rewrite       string
+	AddPrefix     string
+}
+
+func CompileRoutingTable(rules []*HostRule) (*RoutingTable, error) {
+	table := &RoutingTable{
+		Hosts: []*HostRoute{},
+		Dialer: &net.Dialer{
+			Timeout:   time.Duration(TransportDialTimeout) * time.Second,
+			KeepAlive: time.Duration(TransportKeepAlive) * time.Second,
+		},
+	}
+
+	for _, rule := range rules {
+		hostRoute := &HostRoute{
+			Host:     rule.Host,
+			Priority: rule.Priority,
+			Literal:  IsLiteralHost(rule.Host),
+			Paths:    []*PathRoute{},
+		}
+
+		if hostRoute.Literal == false {
+			hostMatcher, err := regexp.Compile("^(?:" + rule.Host + ")$")
+
+			if err != nil {
+				return nil, fmt.Errorf("invalid host pattern %q: %v", rule.Host, err)
+			}
+
+			hostRoute.Matcher = hostMatcher
+		}
+
+		for _, pathRule := range rule.Paths {
+			pathMatcher, err := regexp.Compile(pathRule.Path)
+
+			if err != nil {
+				return nil, fmt.Errorf("invalid path pattern %q for host %q: %v", pathRule.Path, rule.Host, err)
+			}
+
+			pool, err := compilePool(pathRule)
+
+			if err != nil {
+				return nil, fmt.Errorf("invalid upstreams for path %q of host %q: %v", pathRule.Path, rule.Host, err)
+			}
+
+			if pathRule.StripPrefix == true && pathRule.Rewrite != "" {
+				return nil, fmt.Errorf("path %q for host %q can not both strip prefix and rewrite", pathRule.Path, rule.Host)
+			}
+
+			tlsConfig, err := compileUpstreamTLS(pathRule.TLS)
+
+			if err != nil {
+				return nil, fmt.Errorf("invalid tls for path %q of host %q: %v", pathRule.Path, rule.Host, err)
+			}
+
+			if tlsConfig.InsecureSkipVerify == true {
+				log.Printf("Upstream certificates for path %q of host %q are not verified", pathRule.Path, rule.Host)
+			}
+
+			var transport http.RoundTripper = newTransport(table.Dialer, tlsConfig)
+			flush := time.Duration(0)
+
+			switch pathRule.Protocol {
+			case "", PROTOCOL_HTTP:
+			case PROTOCOL_H2C:
+				for _, backend := range pool.Backends {
+					if backend.URL.Scheme != "http" {
+						return nil, fmt.Errorf("h2c upstream %q of path %q for host %q must use http", backend.URL.String(), pathRule.Path, rule.Host)
+					}
+				}
+
+				transport = newH2CTransport(table.Dialer)
+				flush = -1
+			default:
+				return nil, fmt.Errorf("unknown protocol %q for path %q of host %q", pathRule.Protocol, pathRule.Path, rule.Host)
+			}
+
+			addPrefix := pathRule.AddPrefix
+
+			if addPrefix != "" && !strings.HasPrefix(addPrefix, "/") {
+				addPrefix = "/" + addPrefix
+			}
+
+			hostRoute.Paths = append(hostRoute.Paths, &PathRoute{
+				Path:          pathRule.Path,
+				Matcher:       pathMatcher,
+				Pool:          pool,
+				TLSConfig:     tlsConfig,
+				Dialer:        table.Dialer,
+				Transport:     transport,
+				FlushInterval: flush,
+				StripPrefix:   pathRule.StripPrefix,
+				Rewrite:       pathRule.Rewrite,
+				AddPrefix:     strings.TrimSuffix(addPrefix, "/"),
+			})
+		}
+
+		table.Hosts = append(table.Hosts, hostRoute)
+	}
+
+	return table, nil
+}
+
+func compilePool(pathRule *PathRule) (*balancer.Pool, error) {
+	rawUpstreams := pathRule.Upstreams
+
+	if pathRule.Upstream != "" {
+		rawUpstreams = append([]string{pathRule.Upstream}, rawUpstreams...)
+	}
+
+	upstreams := []*url.URL{}
+
+	for _, rawUpstream := range rawUpstreams {
+		upstream, err := url.Parse(rawUpstream)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if upstream.Scheme == "" || upstream.Host == "" {
+			return nil, fmt.Errorf("upstream %q must have scheme and host", rawUpstream)
+		}
+
+		upstreams = append(upstreams, upstream)
+	}
+
+	var healthCheck *balancer.HealthCheck
+
+	if pathRule.HealthCheck != nil {
+		healthCheck = &balancer.HealthCheck{
+			Path:               pathRule.HealthCheck.Path,
+			Interval:           time.Duration(pathRule.HealthCheck.Interval) * time.Second,
+			Timeout:            time.Duration(pathRule.HealthCheck.Timeout) * time.Second,
+			HealthyThreshold:   pathRule.HealthCheck.HealthyThreshold,
+			UnhealthyThreshold: pathRule.HealthCheck.UnhealthyThreshold,
+		}
+
+		if healthCheck.Interval <= 0 {
+			healthCheck.Interval = 10 * time.Second
+		}
+
+		if healthCheck.Timeout <= 0 {
+			healthCheck.Timeout = 2 * time.Second
+		}
+
+		if healthCheck.HealthyThreshold <= 0 {
+			healthCheck.HealthyThreshold = 2
+		}
+
+		if healthCheck.UnhealthyThreshold <= 0 {
+			healthCheck.UnhealthyThreshold = 3
+		}
+	}
+
+	ejectTime := time.Duration(pathRule.EjectTime) * time.Second
+
+	if pathRule.EjectTime == 0 {
+		ejectTime = 30 * time.Second
+	}
+
+	return balancer.NewPool(upstreams, pathRule.Balancer, healthCheck, ejectTime)
+}
+
+// newTransport creates the transport shared by all requests to the upstreams
+// of a path route, so connections to them are pooled and reused.
+func newTransport(dialer *net.Dialer, tlsConfig *tls.Config) *http.Transport {
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   time.Duration(TransportTLSHandshakeTimeout) * time.Second,
+		ResponseHeaderTimeout: time.Duration(TransportResponseHeaderTimeout) * time.Second,
+		IdleConnTimeout:       time.Duration(TransportIdleConnTimeout) * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		MaxIdleConns:          TransportMaxIdleConns,
+		MaxIdleConnsPerHost:   TransportMaxIdleConnsPerHost,
+		MaxConnsPerHost:       TransportMaxConnsPerHost,
+		ForceAttemptHTTP2:     TransportHTTP2,
+	}
+}
+
+// newH2CTransport creates a transport speaking HTTP/2 without TLS, with
+// request and response trailers intact for gRPC.
+func newH2CTransport(dialer *net.Dialer) *http2.Transport {
+	return &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network string, address string, tlsConfig *tls.Config) (net.Conn, error) {
+			return dialer.Dial(network, address)
+		},
+	}
+}
+
+func compileUpstreamTLS(tlsRule *UpstreamTLSRule) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if tlsRule == nil {
+		return tlsConfig, nil
+	}
+
+	tlsConfig.ServerName = tlsRule.ServerName
+	tlsConfig.InsecureSkipVerify = tlsRule.InsecureSkipVerify
+
+	if tlsRule.CAFile != "" {
+		caCertificates, err := ioutil.ReadFile(tlsRule.CAFile)
+
+		if err != nil {
+			return nil, err
+		}
+
+		rootCAs := x509.NewCertPool()
+
+		if rootCAs.AppendCertsFromPEM(caCertificates) == false {
+			return nil, fmt.Errorf("no certificates found in %q", tlsRule.CAFile)
+		}
+
+		tlsConfig.RootCAs = rootCAs
+	}
+
+	if (tlsRule.CertFile == "") != (tlsRule.KeyFile == "") {
+		return nil, errors.New("certfile and keyfile must be set together")
+	}
+
+	if tlsRule.CertFile != "" {
+		certificate, err := tls.LoadX509KeyPair(tlsRule.CertFile, tlsRule.KeyFile)
+
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	return tlsConfig, nil
+}
+
+// StartHealthChecks runs the health checks of every pool in the table until
+// the context is cancelled.
+func (rt *RoutingTable) StartHealthChecks(ctx context.Context) {
+	for _, hostRoute := range rt.Hosts {
+		for _, pathRoute := range hostRoute.Paths {
+			go pathRoute.Pool.RunHealthChecks(ctx, pathRoute.Transport)
+		}
+	}
+}
+
+// CloseIdleConnections closes the idle upstream connections of every route,
+// for a table that was replaced.
+func (rt *RoutingTable) CloseIdleConnections() {
+	for _, hostRoute := range rt.Hosts {
+		for _, pathRoute := range hostRoute.Paths {
+			closer, ok := pathRoute.Transport.(interface{ CloseIdleConnections() })
+
+			if ok == true {
+				closer.CloseIdleConnections()
+			}
+		}
+	}
+}
+
+// MatchHost returns the first literal route equal to the request host, with
+// or without its port. Only when no literal route matches are the regular
+// expression routes tried, in priority order, against the host without its
+// port.
+func (rt *RoutingTable) MatchHost(host string) *HostRoute {
+	hostname := host
+
+	splitHost, _, err := net.SplitHostPort(host)
+
+	if err == nil {
+		hostname = splitHost
+	}
+
+	for _, route := range rt.Hosts {
+		if route.Literal == true && (strings.EqualFold(route.Host, host) || strings.EqualFold(route.Host, hostname)) {
+			return route
+		}
+	}
+
+	for _, route := range rt.Hosts {
+		if route.Literal == false && route.Matcher.MatchString(hostname) {
+			return route
+		}
+	}
+
+	return nil
+}
+
+// MatchPath returns the first path route matching the request path.
+func (hr *HostRoute) MatchPath(path string) *PathRoute {
+	for _, route := range hr.Paths {
+		if route.Matcher.MatchString(path) {
+			return route
+		}
+	}
+
+	return nil
+}
+
+// RewritePath returns the path to send upstream for a request path matched by
+// this route.
+func (pr *PathRoute) RewritePath(path string) string {
+	if pr.Rewrite != "" {
+		path = pr.Matcher.ReplaceAllString(path, pr.Rewrite)
+	} else if pr.StripPrefix == true {
+		location := pr.Matcher.FindStringIndex(path)
+
+		if location != nil && location[0] == 0 {
+			path = path[location[1]:]
+		}
+	}
+
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	return pr.AddPrefix + path
+}
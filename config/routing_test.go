@@ -0,0 +1,170 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package config
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestMatchHost(t *testing.T) {
+	tests := []struct {
+		name     string
+		rules    string
+		host     string
+		expected string
+	}{
+		{"exact", `[{"host": "example.com"}]`, "example.com", "example.com"},
+		{"exact ignores case", `[{"host": "example.com"}]`, "EXAMPLE.com", "example.com"},
+		{"exact with port", `[{"host": "example.com"}]`, "example.com:9998", "example.com"},
+		{"exact rule with port", `[{"host": "example.com:8443"}]`, "example.com:8443", "example.com:8443"},
+		{"exact rule with other port", `[{"host": "example.com:8443"}]`, "example.com:9998", ""},
+		{"exact IPv6", `[{"host": "::1"}]`, "[::1]:9998", "::1"},
+		{"exact is not a suffix", `[{"host": "example.com"}]`, "example.com.evil.net", ""},
+		{"exact is not a pattern", `[{"host": "example.com"}]`, "exampleXcom", ""},
+		{"exact beats regex", `[{"host": "local.*", "priority": 10}, {"host": "localhost"}]`, "localhost", "localhost"},
+		{"regex", `[{"host": "local.*"}, {"host": "localhost"}]`, "localhost.localdomain", "local.*"},
+		{"regex is anchored", `[{"host": "[a-z]+\\.example\\.com"}]`, "a.example.com.evil.net", ""},
+		{"regex is anchored at start", `[{"host": "example\\.com"}]`, "evil-example.com", ""},
+		{"regex with port", `[{"host": ".*\\.example\\.com"}]`, "a.example.com:443", ".*\\.example\\.com"},
+		{"higher priority wins", `[{"host": "a.*"}, {"host": ".*\\.example\\.com", "priority": 5}]`, "a.example.com", ".*\\.example\\.com"},
+		{"equal priority keeps order", `[{"host": "local.*"}, {"host": "localh.*"}]`, "localhost2", "local.*"},
+		{"equal priority keeps order reversed", `[{"host": "localh.*"}, {"host": "local.*"}]`, "localhost2", "localh.*"},
+		{"no match", `[{"host": "example.com"}, {"host": ".*\\.example\\.com"}]`, "example.net", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var rawRules interface{}
+
+			err := json.Unmarshal([]byte(test.rules), &rawRules)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rules, err := parseProxyRules(rawRules)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			table, err := CompileRoutingTable(rules)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			route := table.MatchHost(test.host)
+			result := ""
+
+			if route != nil {
+				result = route.Host
+			}
+
+			if result != test.expected {
+				t.Fatalf("MatchHost(%q) = %q, expected %q", test.host, result, test.expected)
+			}
+		})
+	}
+}
+
+func TestRewritePath(t *testing.T) {
+	tests := []struct {
+		name        string
+		pattern     string
+		stripPrefix bool
+		rewrite     string
+		addPrefix   string
+		path        string
+		expected    string
+	}{
+		{"unchanged", "^/grafana", false, "", "", "/grafana/d/1", "/grafana/d/1"},
+		{"strip prefix", "^/grafana", true, "", "", "/grafana/d/1", "/d/1"},
+		{"strip prefix keeps slash", "^/grafana/", true, "", "", "/grafana/d/1", "/d/1"},
+		{"strip prefix to empty", "^/grafana", true, "", "", "/grafana", "/"},
+		{"strip prefix not at start", "/grafana", true, "", "", "/apps/grafana/d", "/apps/grafana/d"},
+		{"strip prefix root path", "^/", true, "", "", "/", "/"},
+		{"root path", "^/", false, "", "", "/", "/"},
+		{"root path with prefix", "^/", false, "", "/app", "/", "/app/"},
+		{"regex replacement", "^/api/v(\\d+)/(.*)$", false, "/v$1/$2", "", "/api/v2/users", "/v2/users"},
+		{"named group replacement", "^/users/(?P<id>\\d+)$", false, "/profile/${id}", "", "/users/42", "/profile/42"},
+		{"replacement to empty", "^/old(.*)$", false, "$1", "", "/old", "/"},
+		{"replacement without slash", "^/old/(.*)$", false, "$1", "", "/old/page", "/page"},
+		{"add prefix", "^/", false, "", "/base", "/page", "/base/page"},
+		{"strip and add prefix", "^/grafana", true, "", "/monitoring", "/grafana/d/1", "/monitoring/d/1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			route := &PathRoute{
+				Path:        test.pattern,
+				Matcher:     regexp.MustCompile(test.pattern),
+				StripPrefix: test.stripPrefix,
+				Rewrite:     test.rewrite,
+				AddPrefix:   test.addPrefix,
+			}
+
+			result := route.RewritePath(test.path)
+
+			if result != test.expected {
+				t.Fatalf("RewritePath(%q) = %q, expected %q", test.path, result, test.expected)
+			}
+		})
+	}
+}
+
+func TestCompileRoutingTableInvalidPatterns(t *testing.T) {
+	tests := []struct {
+		name     string
+		rules    []*HostRule
+		expected []string
+	}{
+		{
+			name: "bad host regex",
+			rules: []*HostRule{
+				{Host: "(app|admin\\.example\\.com"},
+			},
+			expected: []string{"invalid host pattern", "(app|admin\\.example\\.com"},
+		},
+		{
+			name: "bad path regex",
+			rules: []*HostRule{
+				{Host: "example.com", Paths: []*PathRule{{Path: "^/api/[v", Upstream: "http://localhost:9999"}}},
+			},
+			expected: []string{"invalid path pattern", "^/api/[v", "example.com"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := CompileRoutingTable(test.rules)
+
+			if err == nil {
+				t.Fatal("invalid pattern compiled")
+			}
+
+			for _, expected := range test.expected {
+				if strings.Contains(err.Error(), expected) == false {
+					t.Fatalf("error %q does not name %q", err.Error(), expected)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,225 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/mitchellh/mapstructure"
+)
+
+// HostRule binds a host (literal name or regular expression) to an ordered
+// list of path rules. Rules with a higher Priority are evaluated first, rules
+// with equal priority keep the order in which they are written in the config.
+type HostRule struct {
+	Host     string
+	Priority int
+	Paths    []*PathRule
+}
+
+// PathRule forwards requests whose path matches Path to Upstream, or to one
+// of Upstreams chosen by the Balancer policy. The path sent upstream can be
+// changed with StripPrefix, which removes the matched prefix, or Rewrite,
+// which replaces the match and may refer to capture groups as $1, ${name}.
+// AddPrefix is then prepended to the result. Upstreams that can not be
+// connected to are ejected for EjectTime seconds, 30 by default, a negative
+// value disables the ejection. The last available upstream is never ejected.
+// TLS configures how https upstreams are verified. Protocol "h2c" talks
+// cleartext HTTP/2 to http upstreams, as needed for gRPC servers without TLS,
+// https upstreams negotiate HTTP/2 on their own.
+type PathRule struct {
+	Path        string
+	Upstream    string
+	Upstreams   []string
+	Balancer    string
+	HealthCheck *HealthCheckRule
+	TLS         *UpstreamTLSRule
+	Protocol    string
+	EjectTime   int64
+	StripPrefix bool
+	Rewrite     string
+	AddPrefix   string
+}
+
+// UpstreamTLSRule configures the TLS client used for a rule's https
+// upstreams. Upstream certificates are verified against the system roots, or
+// against CAFile when set, for ServerName or else the upstream host name.
+// CertFile and KeyFile hold a client certificate for mutual TLS.
+// InsecureSkipVerify turns verification off and must be set explicitly.
+type UpstreamTLSRule struct {
+	CAFile             string
+	ServerName         string
+	CertFile           string
+	KeyFile            string
+	InsecureSkipVerify bool
+}
+
+// HealthCheckRule configures active health checks of a rule's upstreams.
+// Interval and Timeout are in seconds.
+type HealthCheckRule struct {
+	Path               string
+	Interval           int64
+	Timeout            int64
+	HealthyThreshold   int
+	UnhealthyThreshold int
+}
+
+type hostRuleConfig struct {
+	Host     string
+	Priority int
+	Paths    []map[string]interface{}
+}
+
+// parseProxyRules accepts either the ordered list format
+//
+//	"rules": [{"host": "localhost", "priority": 10, "paths": [{"/": "http://localhost:9999"}]}]
+//
+// or the legacy map format keyed by host. JSON objects carry no order, so
+// legacy hosts are sorted by name to at least keep the evaluation stable.
+func parseProxyRules(rawRules interface{}) ([]*HostRule, error) {
+	hostConfigs := []*hostRuleConfig{}
+
+	switch value := rawRules.(type) {
+	case nil:
+		return []*HostRule{}, nil
+	case []interface{}:
+		err := mapstructure.Decode(value, &hostConfigs)
+
+		if err != nil {
+			return nil, err
+		}
+	case map[string]interface{}:
+		log.Println("Map format of rules does not preserve order, please use a list of host rules")
+
+		hostKeys := []string{}
+
+		for hostKey := range value {
+			hostKeys = append(hostKeys, hostKey)
+		}
+
+		sort.Strings(hostKeys)
+
+		for _, hostKey := range hostKeys {
+			var paths []map[string]interface{}
+
+			err := mapstructure.Decode(value[hostKey], &paths)
+
+			if err != nil {
+				return nil, err
+			}
+
+			hostConfigs = append(hostConfigs, &hostRuleConfig{
+				Host:  hostKey,
+				Paths: paths,
+			})
+		}
+	default:
+		return nil, errors.New("rules must be a list of host rules")
+	}
+
+	rules := []*HostRule{}
+
+	for _, hostConfig := range hostConfigs {
+		if hostConfig.Host == "" {
+			return nil, errors.New("host rule without host")
+		}
+
+		paths, err := parsePathRules(hostConfig.Paths)
+
+		if err != nil {
+			return nil, fmt.Errorf("rules for host %q: %v", hostConfig.Host, err)
+		}
+
+		rules = append(rules, &HostRule{
+			Host:     hostConfig.Host,
+			Priority: hostConfig.Priority,
+			Paths:    paths,
+		})
+	}
+
+	sort.SliceStable(rules, func(i, j int) bool {
+		return rules[i].Priority > rules[j].Priority
+	})
+
+	return rules, nil
+}
+
+// parsePathRules accepts both the object form
+//
+//	{"path": "/grafana", "upstream": "http://grafana:3000", "stripprefix": true}
+//
+// and the short form {"/grafana": "http://grafana:3000"}.
+func parsePathRules(rawPaths []map[string]interface{}) ([]*PathRule, error) {
+	paths := []*PathRule{}
+
+	for _, rawPath := range rawPaths {
+		_, ok := rawPath["path"]
+
+		if ok == true {
+			path := &PathRule{}
+
+			decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+				ErrorUnused: true,
+				Result:      path,
+			})
+
+			if err != nil {
+				return nil, err
+			}
+
+			err = decoder.Decode(rawPath)
+
+			if err != nil {
+				return nil, err
+			}
+
+			paths = append(paths, path)
+			continue
+		}
+
+		for _, from := range sortedKeys(rawPath) {
+			to, ok := rawPath[from].(string)
+
+			if ok == false {
+				return nil, fmt.Errorf("upstream for path %q must be a string", from)
+			}
+
+			paths = append(paths, &PathRule{
+				Path:     from,
+				Upstream: to,
+			})
+		}
+	}
+
+	return paths, nil
+}
+
+// sortedKeys returns the keys of a path rule in a stable order.
+func sortedKeys(rule map[string]interface{}) []string {
+	keys := []string{}
+
+	for key := range rule {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,131 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package config
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParseProxyRules(t *testing.T) {
+	tests := []struct {
+		name     string
+		rules    string
+		expected []string
+		fails    bool
+	}{
+		{
+			name:     "no rules",
+			rules:    `null`,
+			expected: []string{},
+		},
+		{
+			name:     "list format",
+			rules:    `[{"host": "b.example.com", "paths": [{"/": "http://b:80"}]}, {"host": "a.example.com", "paths": [{"path": "/api", "upstream": "http://a:80", "stripprefix": true}]}]`,
+			expected: []string{"b.example.com / http://b:80", "a.example.com /api http://a:80 strip"},
+		},
+		{
+			name:     "short form paths in order",
+			rules:    `[{"host": "example.com", "paths": [{"/b": "http://b:80"}, {"/a": "http://a:80"}]}]`,
+			expected: []string{"example.com /b http://b:80", "example.com /a http://a:80"},
+		},
+		{
+			name:     "legacy map format",
+			rules:    `{"b.example.com": [{"/": "http://b:80"}], "a.example.com": [{"/": "http://a:80"}]}`,
+			expected: []string{"a.example.com / http://a:80", "b.example.com / http://b:80"},
+		},
+		{
+			name:     "priority ordering",
+			rules:    `[{"host": "low", "paths": []}, {"host": "high", "priority": 10, "paths": []}, {"host": "default", "paths": []}, {"host": "middle", "priority": 5, "paths": []}]`,
+			expected: []string{"high", "middle", "low", "default"},
+		},
+		{
+			name:  "missing host",
+			rules: `[{"paths": [{"/": "http://localhost:80"}]}]`,
+			fails: true,
+		},
+		{
+			name:  "empty host",
+			rules: `[{"host": "", "paths": []}]`,
+			fails: true,
+		},
+		{
+			name:  "unknown path field",
+			rules: `[{"host": "example.com", "paths": [{"path": "/", "upstrem": "http://localhost:80"}]}]`,
+			fails: true,
+		},
+		{
+			name:  "short form upstream not a string",
+			rules: `[{"host": "example.com", "paths": [{"/": 80}]}]`,
+			fails: true,
+		},
+		{
+			name:  "not a list",
+			rules: `"example.com"`,
+			fails: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var rawRules interface{}
+
+			err := json.Unmarshal([]byte(test.rules), &rawRules)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rules, err := parseProxyRules(rawRules)
+
+			if test.fails == true {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			result := []string{}
+
+			for _, rule := range rules {
+				if len(rule.Paths) == 0 {
+					result = append(result, rule.Host)
+				}
+
+				for _, path := range rule.Paths {
+					summary := rule.Host + " " + path.Path + " " + path.Upstream
+
+					if path.StripPrefix == true {
+						summary += " strip"
+					}
+
+					result = append(result, summary)
+				}
+			}
+
+			if reflect.DeepEqual(result, test.expected) == false {
+				t.Fatalf("got %q, expected %q", result, test.expected)
+			}
+		})
+	}
+}
@@ -3,10 +3,14 @@ module github.com/netclave/proxy
 go 1.14
 
 require (
+	github.com/fsnotify/fsnotify v1.4.9
 	github.com/go-sql-driver/mysql v1.5.0 // indirect
+	github.com/mitchellh/mapstructure v1.1.2
 	github.com/netclave/apis v0.0.0-20201019102527-6ee865c69107
 	github.com/netclave/common v0.0.0-20210117123909-106977a3f48e
 	github.com/spf13/pflag v1.0.5
 	github.com/spf13/viper v1.7.1
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
+	golang.org/x/net v0.0.0-20200707034311-ab3426394381
 	google.golang.org/grpc v1.31.0
 )
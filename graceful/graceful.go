@@ -0,0 +1,278 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package graceful
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LISTENERS_ENV passes the listening sockets to a new process on upgrade, as
+// address=fd pairs separated by ";".
+const LISTENERS_ENV = "NETCLAVE_LISTENERS"
+
+// READY_ENV passes the file descriptor of the pipe a new process reports on
+// once it serves.
+const READY_ENV = "NETCLAVE_READY"
+
+type namedListener struct {
+	address  string
+	listener net.Listener
+}
+
+var mutex sync.Mutex
+var inherited map[string]*os.File
+var listeners []*namedListener
+
+func loadInherited() {
+	if inherited != nil {
+		return
+	}
+
+	inherited = map[string]*os.File{}
+
+	spec := os.Getenv(LISTENERS_ENV)
+	os.Unsetenv(LISTENERS_ENV)
+
+	if spec == "" {
+		return
+	}
+
+	for _, entry := range strings.Split(spec, ";") {
+		separator := strings.LastIndex(entry, "=")
+
+		if separator < 0 {
+			log.Printf("Invalid inherited listener %q", entry)
+			continue
+		}
+
+		fd, err := strconv.Atoi(entry[separator+1:])
+
+		if err != nil {
+			log.Printf("Invalid inherited listener %q", entry)
+			continue
+		}
+
+		inherited[entry[:separator]] = os.NewFile(uintptr(fd), entry[:separator])
+	}
+}
+
+// Listen returns the TCP listener for the address, taking over the socket of
+// the previous process after an upgrade or binding a new one.
+func Listen(address string) (net.Listener, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	loadInherited()
+
+	var listener net.Listener
+	var err error
+
+	file, ok := inherited[address]
+
+	if ok == true {
+		delete(inherited, address)
+
+		listener, err = net.FileListener(file)
+		file.Close()
+
+		if err == nil {
+			log.Println("Inherited listener for " + address)
+		}
+	} else {
+		listener, err = net.Listen("tcp", address)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	listeners = append(listeners, &namedListener{
+		address:  address,
+		listener: listener,
+	})
+
+	return listener, nil
+}
+
+// CloseInherited closes the sockets passed on by the previous process that
+// are no longer configured.
+func CloseInherited() {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	loadInherited()
+
+	for address, file := range inherited {
+		log.Println("Closing unused inherited listener for " + address)
+
+		file.Close()
+		delete(inherited, address)
+	}
+}
+
+// Ready tells the process that started this one with Upgrade that it serves,
+// so the old process can shut down. It does nothing when the process was not
+// started by an upgrade.
+func Ready() {
+	fd := os.Getenv(READY_ENV)
+	os.Unsetenv(READY_ENV)
+
+	if fd == "" {
+		return
+	}
+
+	number, err := strconv.Atoi(fd)
+
+	if err != nil {
+		log.Printf("Invalid ready pipe %q", fd)
+		return
+	}
+
+	pipe := os.NewFile(uintptr(number), "ready")
+	defer pipe.Close()
+
+	_, err = pipe.Write([]byte{1})
+
+	if err != nil {
+		log.Println("Can not report ready: " + err.Error())
+	}
+}
+
+// Upgrade starts a new process of the current binary with the same arguments
+// and hands it the listening sockets. Both processes accept connections until
+// this one is shut down, so no connection is refused during the switch.
+// Upgrade returns once the new process called Ready. A process that exits or
+// is not ready within the timeout is killed and an error is returned, this
+// process then keeps serving.
+func Upgrade(timeout time.Duration) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	executable, err := os.Executable()
+
+	if err != nil {
+		return err
+	}
+
+	files := []*os.File{}
+	spec := []string{}
+
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+
+	for _, named := range listeners {
+		tcpListener, ok := named.listener.(*net.TCPListener)
+
+		if ok == false {
+			return errors.New("Can not pass on listener for " + named.address)
+		}
+
+		file, err := tcpListener.File()
+
+		if err != nil {
+			return err
+		}
+
+		// ExtraFiles start at file descriptor 3
+		spec = append(spec, named.address+"="+strconv.Itoa(3+len(files)))
+		files = append(files, file)
+	}
+
+	readyReader, readyWriter, err := os.Pipe()
+
+	if err != nil {
+		return err
+	}
+	defer readyReader.Close()
+
+	readyFD := 3 + len(files)
+	listenerCount := len(files)
+	files = append(files, readyWriter)
+
+	environment := []string{}
+
+	for _, variable := range os.Environ() {
+		if !strings.HasPrefix(variable, LISTENERS_ENV+"=") && !strings.HasPrefix(variable, READY_ENV+"=") {
+			environment = append(environment, variable)
+		}
+	}
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Env = append(environment, LISTENERS_ENV+"="+strings.Join(spec, ";"), READY_ENV+"="+strconv.Itoa(readyFD))
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+
+	err = cmd.Start()
+
+	// only the new process may hold the write end, so reading ends when it
+	// exits without reporting ready
+	readyWriter.Close()
+
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Started process %d with %d listeners", cmd.Process.Pid, listenerCount)
+
+	ready := make(chan error, 1)
+
+	go func() {
+		_, err := readyReader.Read(make([]byte, 1))
+		ready <- err
+	}()
+
+	exited := make(chan error, 1)
+
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case err = <-ready:
+		if err == nil {
+			log.Printf("Process %d is ready", cmd.Process.Pid)
+			return nil
+		}
+
+		err = fmt.Errorf("process %d exited before it was ready", cmd.Process.Pid)
+	case waitErr := <-exited:
+		err = fmt.Errorf("process %d exited before it was ready: %v", cmd.Process.Pid, waitErr)
+	case <-timer.C:
+		err = fmt.Errorf("process %d not ready after %s", cmd.Process.Pid, timeout.String())
+	}
+
+	cmd.Process.Kill()
+
+	return err
+}
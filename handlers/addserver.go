@@ -20,6 +20,7 @@ import (
 	"context"
 	"encoding/json"
 	"log"
+	"sync"
 
 	api "github.com/netclave/apis/proxy/api"
 	"github.com/netclave/common/cryptoutils"
@@ -29,6 +30,7 @@ import (
 )
 
 type GrpcServer struct {
+	SyncMonitor *SyncMonitor
 }
 
 func (s *GrpcServer) AddIdentityProvider(ctx context.Context, in *api.AddIdentityProviderRequest) (*api.AddIdentityProviderResponse, error) {
@@ -200,6 +202,9 @@ type WalletsAndServices struct {
 	Services   map[string][]string
 }
 
+// GetWalletsAndServiceInternal merges the wallets and services of all
+// identity providers. Identity providers that can not be reached are left
+// out, an error is only returned when none answered.
 func GetWalletsAndServiceInternal() (*WalletsAndServices, error) {
 	cryptoStorage := component.CreateCryptoStorage()
 
@@ -214,40 +219,17 @@ func GetWalletsAndServiceInternal() (*WalletsAndServices, error) {
 		Services:   map[string][]string{},
 	}
 
-	for _, identityProvider := range identityProviders {
-		publicKey, err := cryptoStorage.RetrievePublicKey(identityProvider.IdentificatorID)
+	var mutex sync.Mutex
 
-		if err != nil {
-			return nil, err
-		}
-		openersURL := identityProvider.IdentificatorURL + "/getWalletsAndServices"
-
-		//log.Println("Url: " + openersURL)
-
-		openerID := component.ComponentIdentificatorID
-		privateKeyPEM := component.ComponentPrivateKey
-		publicKeyPEM := component.ComponentPublicKey
-
-		request, err := jsonutils.SignAndEncryptResponse("", openerID,
-			privateKeyPEM, publicKeyPEM, publicKey, false)
-
-		response, _, _, err := httputils.MakePostRequest(openersURL, request, true, component.ComponentPrivateKey, cryptoStorage)
+	err = forEachIdentityProvider(identityProviders, func(identityProvider *cryptoutils.Identificator) error {
+		res, err := fetchWalletsAndServices(cryptoStorage, identityProvider)
 
 		if err != nil {
-			log.Println("Error: " + err.Error())
-			return nil, err
+			return err
 		}
 
-		//log.Println("Response: " + response)
-
-		var res WalletsAndServices
-
-		err = json.Unmarshal([]byte(response), &res)
-
-		if err != nil {
-			log.Println("Error: " + err.Error())
-			return nil, err
-		}
+		mutex.Lock()
+		defer mutex.Unlock()
 
 		for key, value := range res.PublicKeys {
 			result.PublicKeys[key] = value
@@ -265,11 +247,74 @@ func GetWalletsAndServiceInternal() (*WalletsAndServices, error) {
 				}
 			}
 		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
 	}
 
 	return result, nil
 }
 
+func fetchWalletsAndServices(cryptoStorage *cryptoutils.CryptoStorage, identityProvider *cryptoutils.Identificator) (*WalletsAndServices, error) {
+	publicKey, err := cryptoStorage.RetrievePublicKey(identityProvider.IdentificatorID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	openersURL := identityProvider.IdentificatorURL + "/getWalletsAndServices"
+
+	openerID := component.ComponentIdentificatorID
+	privateKeyPEM := component.ComponentPrivateKey
+	publicKeyPEM := component.ComponentPublicKey
+
+	request, err := jsonutils.SignAndEncryptResponse("", openerID,
+		privateKeyPEM, publicKeyPEM, publicKey, false)
+
+	if err != nil {
+		return nil, err
+	}
+
+	response, _, _, err := httputils.MakePostRequest(openersURL, request, true, component.ComponentPrivateKey, cryptoStorage)
+
+	if err != nil {
+		return nil, err
+	}
+
+	res := &WalletsAndServices{}
+
+	err = json.Unmarshal([]byte(response), res)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// SyncWallets fetches the wallets and services of a single identity provider
+// and stores them. It returns the number of wallets.
+func SyncWallets(identityProvider *cryptoutils.Identificator) (int, error) {
+	cryptoStorage := component.CreateCryptoStorage()
+
+	walletsAndServices, err := fetchWalletsAndServices(cryptoStorage, identityProvider)
+
+	if err != nil {
+		return 0, err
+	}
+
+	err = StoreWalletsAndServices(component.CreateDataStorage(), identityProvider.IdentificatorID, walletsAndServices)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return len(walletsAndServices.PublicKeys), nil
+}
+
 func (s *GrpcServer) GetWalletsAndServices(ctx context.Context, in *api.GetWalletsAndServicesRequest) (*api.GetWalletsAndServicesResponse, error) {
 	result := []string{}
 
@@ -297,6 +342,9 @@ func (s *GrpcServer) GetWalletsAndServices(ctx context.Context, in *api.GetWalle
 	}, nil
 }
 
+// GetActiveTokensInternal merges the active tokens of all identity
+// providers. Identity providers that can not be reached are left out, an
+// error is only returned when none answered.
 func GetActiveTokensInternal() (map[string][]string, error) {
 	cryptoStorage := component.CreateCryptoStorage()
 
@@ -308,42 +356,19 @@ func GetActiveTokensInternal() (map[string][]string, error) {
 
 	result := map[string][]string{}
 
-	for _, identityProvider := range identityProviders {
-		publicKey, err := cryptoStorage.RetrievePublicKey(identityProvider.IdentificatorID)
-
-		if err != nil {
-			return nil, err
-		}
-		openersURL := identityProvider.IdentificatorURL + "/getActiveTokens"
+	var mutex sync.Mutex
 
-		//log.Println("Url: " + openersURL)
-
-		openerID := component.ComponentIdentificatorID
-		privateKeyPEM := component.ComponentPrivateKey
-		publicKeyPEM := component.ComponentPublicKey
-
-		request, err := jsonutils.SignAndEncryptResponse("", openerID,
-			privateKeyPEM, publicKeyPEM, publicKey, false)
-
-		response, _, _, err := httputils.MakePostRequest(openersURL, request, true, component.ComponentPrivateKey, cryptoStorage)
+	err = forEachIdentityProvider(identityProviders, func(identityProvider *cryptoutils.Identificator) error {
+		changes, err := fetchActiveTokens(cryptoStorage, identityProvider, "")
 
 		if err != nil {
-			log.Println("Error: " + err.Error())
-			return nil, err
+			return err
 		}
 
-		//log.Println(response)
-
-		var activeTokensForIdentityProvider map[string][]string
+		mutex.Lock()
+		defer mutex.Unlock()
 
-		err = json.Unmarshal([]byte(response), &activeTokensForIdentityProvider)
-
-		if err != nil {
-			log.Println("Error: " + err.Error())
-			return nil, err
-		}
-
-		for key, value := range activeTokensForIdentityProvider {
+		for key, value := range changes.Tokens {
 			_, ok := result[key]
 
 			if ok == false {
@@ -354,6 +379,12 @@ func GetActiveTokensInternal() (map[string][]string, error) {
 				result[key] = append(result[key], token)
 			}
 		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
 	}
 
 	return result, nil
@@ -0,0 +1,146 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/netclave/proxy/adminapi"
+	"github.com/netclave/proxy/component"
+	"github.com/netclave/proxy/config"
+)
+
+func (s *GrpcServer) ListBans(ctx context.Context, in *adminapi.ListBansRequest) (*adminapi.ListBansResponse, error) {
+	fail2banDataStorage := component.CreateFail2BanDataStorage()
+
+	records, err := ListBans(fail2banDataStorage)
+
+	if err != nil {
+		log.Println("Error: " + err.Error())
+		return &adminapi.ListBansResponse{}, err
+	}
+
+	bans := []*adminapi.Ban{}
+
+	for _, record := range records {
+		bans = append(bans, &adminapi.Ban{
+			Ip:        record.IP,
+			BannedAt:  record.BannedAt,
+			ExpiresAt: record.ExpiresAt,
+			Reason:    record.Reason,
+		})
+	}
+
+	return &adminapi.ListBansResponse{
+		Bans: bans,
+	}, nil
+}
+
+func (s *GrpcServer) BanAddress(ctx context.Context, in *adminapi.BanAddressRequest) (*adminapi.BanAddressResponse, error) {
+	fail2banDataStorage := component.CreateFail2BanDataStorage()
+
+	reason := in.Reason
+
+	if reason == "" {
+		reason = "Banned manually"
+	}
+
+	err := BanAddress(fail2banDataStorage, in.Ip, in.Ttl, reason)
+
+	if err != nil {
+		log.Println("Error: " + err.Error())
+		return &adminapi.BanAddressResponse{}, err
+	}
+
+	return &adminapi.BanAddressResponse{
+		Response: "Banned " + in.Ip,
+	}, nil
+}
+
+func (s *GrpcServer) UnbanAddress(ctx context.Context, in *adminapi.UnbanAddressRequest) (*adminapi.UnbanAddressResponse, error) {
+	fail2banDataStorage := component.CreateFail2BanDataStorage()
+
+	err := UnbanAddress(fail2banDataStorage, in.Ip)
+
+	if err != nil {
+		log.Println("Error: " + err.Error())
+		return &adminapi.UnbanAddressResponse{}, err
+	}
+
+	return &adminapi.UnbanAddressResponse{
+		Response: "Unbanned " + in.Ip,
+	}, nil
+}
+
+func (s *GrpcServer) SyncStatus(ctx context.Context, in *adminapi.SyncStatusRequest) (*adminapi.SyncStatusResponse, error) {
+	if s.SyncMonitor == nil {
+		return &adminapi.SyncStatusResponse{}, errors.New("Sync is not running")
+	}
+
+	identityProviders := []*adminapi.IdentityProviderSyncStatus{}
+
+	for _, status := range s.SyncMonitor.Status() {
+		lastError := ""
+		lastErrorAt := time.Time{}
+
+		if status.Wallets.LastError != "" {
+			lastError = "wallets: " + status.Wallets.LastError
+			lastErrorAt = status.Wallets.LastErrorTime
+		}
+
+		if status.Tokens.LastError != "" && status.Tokens.LastErrorTime.After(lastErrorAt) {
+			lastError = "tokens: " + status.Tokens.LastError
+			lastErrorAt = status.Tokens.LastErrorTime
+		}
+
+		backoff := status.Wallets.Backoff
+
+		if status.Tokens.Backoff > backoff {
+			backoff = status.Tokens.Backoff
+		}
+
+		identityProviders = append(identityProviders, &adminapi.IdentityProviderSyncStatus{
+			Id:             status.IdentityProviderID,
+			LastWalletSync: milliseconds(status.Wallets.LastSuccess),
+			LastTokenSync:  milliseconds(status.Tokens.LastSuccess),
+			LastError:      lastError,
+			LastErrorAt:    milliseconds(lastErrorAt),
+			Errors:         status.Wallets.Errors + status.Tokens.Errors,
+			Wallets:        int64(status.Wallets.Items),
+			ActiveTokens:   int64(status.ActiveTokens),
+			Backoff:        int64(backoff / time.Millisecond),
+			Stale:          status.Stale,
+		})
+	}
+
+	return &adminapi.SyncStatusResponse{
+		StalePolicy:       config.SyncStalePolicy,
+		StaleThreshold:    config.SyncStaleThreshold,
+		IdentityProviders: identityProviders,
+	}, nil
+}
+
+func milliseconds(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+
+	return t.UnixNano() / int64(time.Millisecond)
+}
@@ -0,0 +1,120 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package handlers
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const NETCLAVE_COOKIE_PREFIX = "netclave-token-"
+
+var ErrNotNetClaveCookie = errors.New("Not a NetClave cookie")
+var ErrMalformedNetClaveToken = errors.New("NetClave token in wrong format")
+
+// NetClaveToken is the content of a netclave-token-<identityProviderID>
+// cookie, whose value is "walletID,token,signature". Source tells where in
+// the request the token was found.
+type NetClaveToken struct {
+	IdentityProviderID string
+	WalletID           string
+	Token              string
+	Signature          string
+	Source             string
+}
+
+// ParseNetClaveCookie returns ErrNotNetClaveCookie for cookies of other
+// applications and ErrMalformedNetClaveToken for NetClave cookies that can
+// not be decoded.
+func ParseNetClaveCookie(cookie *http.Cookie) (*NetClaveToken, error) {
+	if !strings.HasPrefix(cookie.Name, NETCLAVE_COOKIE_PREFIX) {
+		return nil, ErrNotNetClaveCookie
+	}
+
+	identityProviderID := strings.TrimPrefix(cookie.Name, NETCLAVE_COOKIE_PREFIX)
+
+	return ParseNetClaveToken(identityProviderID, cookie.Value)
+}
+
+// ParseNetClaveToken decodes "walletID,token,signature". The value may also be
+// URL encoded or base64 encoded as a whole.
+func ParseNetClaveToken(identityProviderID string, value string) (*NetClaveToken, error) {
+	if identityProviderID == "" {
+		return nil, ErrMalformedNetClaveToken
+	}
+
+	if strings.Contains(value, "%") {
+		unescapedValue, err := url.PathUnescape(value)
+
+		if err != nil {
+			return nil, ErrMalformedNetClaveToken
+		}
+
+		value = unescapedValue
+	}
+
+	tokens := strings.Split(value, ",")
+
+	if len(tokens) != 3 {
+		decodedValue, ok := decodeBase64(value)
+
+		if ok == false {
+			return nil, ErrMalformedNetClaveToken
+		}
+
+		tokens = strings.Split(decodedValue, ",")
+	}
+
+	if len(tokens) != 3 {
+		return nil, ErrMalformedNetClaveToken
+	}
+
+	for _, token := range tokens {
+		if token == "" {
+			return nil, ErrMalformedNetClaveToken
+		}
+	}
+
+	return &NetClaveToken{
+		IdentityProviderID: identityProviderID,
+		WalletID:           tokens[0],
+		Token:              tokens[1],
+		Signature:          tokens[2],
+	}, nil
+}
+
+func decodeBase64(value string) (string, bool) {
+	encodings := []*base64.Encoding{
+		base64.StdEncoding,
+		base64.RawStdEncoding,
+		base64.URLEncoding,
+		base64.RawURLEncoding,
+	}
+
+	for _, encoding := range encodings {
+		decoded, err := encoding.DecodeString(value)
+
+		if err == nil {
+			return string(decoded), true
+		}
+	}
+
+	return "", false
+}
@@ -0,0 +1,191 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package handlers
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestParseNetClaveCookie(t *testing.T) {
+	valid := &NetClaveToken{
+		IdentityProviderID: "idp1",
+		WalletID:           "wallet1",
+		Token:              "token1",
+		Signature:          "c2lnbmF0dXJl+/==",
+	}
+
+	tests := []struct {
+		name     string
+		cookie   *http.Cookie
+		expected *NetClaveToken
+		err      error
+	}{
+		{
+			name:     "valid",
+			cookie:   &http.Cookie{Name: "netclave-token-idp1", Value: "wallet1,token1,c2lnbmF0dXJl+/=="},
+			expected: valid,
+		},
+		{
+			name:     "URL encoded",
+			cookie:   &http.Cookie{Name: "netclave-token-idp1", Value: url.QueryEscape("wallet1,token1,c2lnbmF0dXJl+/==")},
+			expected: valid,
+		},
+		{
+			name:     "base64",
+			cookie:   &http.Cookie{Name: "netclave-token-idp1", Value: base64.StdEncoding.EncodeToString([]byte("wallet1,token1,c2lnbmF0dXJl+/=="))},
+			expected: valid,
+		},
+		{
+			name:     "raw URL base64",
+			cookie:   &http.Cookie{Name: "netclave-token-idp1", Value: base64.RawURLEncoding.EncodeToString([]byte("wallet1,token1,c2lnbmF0dXJl+/=="))},
+			expected: valid,
+		},
+		{
+			name:   "other application",
+			cookie: &http.Cookie{Name: "session", Value: "wallet1,token1,signature"},
+			err:    ErrNotNetClaveCookie,
+		},
+		{
+			name:   "no identity provider",
+			cookie: &http.Cookie{Name: "netclave-token-", Value: "wallet1,token1,signature"},
+			err:    ErrMalformedNetClaveToken,
+		},
+		{
+			name:   "empty value",
+			cookie: &http.Cookie{Name: "netclave-token-idp1", Value: ""},
+			err:    ErrMalformedNetClaveToken,
+		},
+		{
+			name:   "empty segment",
+			cookie: &http.Cookie{Name: "netclave-token-idp1", Value: "wallet1,,signature"},
+			err:    ErrMalformedNetClaveToken,
+		},
+		{
+			name:   "too few segments",
+			cookie: &http.Cookie{Name: "netclave-token-idp1", Value: "wallet1,token1"},
+			err:    ErrMalformedNetClaveToken,
+		},
+		{
+			name:   "extra segments",
+			cookie: &http.Cookie{Name: "netclave-token-idp1", Value: "wallet1,token1,signature,extra"},
+			err:    ErrMalformedNetClaveToken,
+		},
+		{
+			name:   "bad escape",
+			cookie: &http.Cookie{Name: "netclave-token-idp1", Value: "wallet1%zz,token1,signature"},
+			err:    ErrMalformedNetClaveToken,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			netClaveToken, err := ParseNetClaveCookie(test.cookie)
+
+			if err != test.err {
+				t.Fatalf("got error %v, expected %v", err, test.err)
+			}
+
+			if reflect.DeepEqual(netClaveToken, test.expected) == false {
+				t.Fatalf("got %+v, expected %+v", netClaveToken, test.expected)
+			}
+		})
+	}
+}
+
+func TestExtractNetClaveTokensFromCookies(t *testing.T) {
+	tests := []struct {
+		name      string
+		header    string
+		walletIDs []string
+		present   bool
+	}{
+		{
+			name:      "no cookies",
+			header:    "",
+			walletIDs: []string{},
+			present:   false,
+		},
+		{
+			name:      "other cookies only",
+			header:    "session=abc; theme=dark",
+			walletIDs: []string{},
+			present:   false,
+		},
+		{
+			name:      "missing =",
+			header:    "netclave-token-idp1",
+			walletIDs: []string{},
+			present:   true,
+		},
+		{
+			name:      "malformed NetClave cookie",
+			header:    "netclave-token-idp1=wallet1",
+			walletIDs: []string{},
+			present:   true,
+		},
+		{
+			name:      "multiple cookies",
+			header:    "session=abc; netclave-token-idp1=wallet1,token1,sig1; netclave-token-idp2=wallet2,token2,sig2",
+			walletIDs: []string{"wallet1", "wallet2"},
+			present:   true,
+		},
+		{
+			name:      "valid and malformed",
+			header:    "netclave-token-idp1=broken; netclave-token-idp2=wallet2,token2,sig2",
+			walletIDs: []string{"wallet2"},
+			present:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, err := http.NewRequest("GET", "http://localhost/", nil)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if test.header != "" {
+				r.Header.Set("Cookie", test.header)
+			}
+
+			netClaveTokens, present := extractNetClaveTokens(r)
+
+			walletIDs := []string{}
+
+			for _, netClaveToken := range netClaveTokens {
+				if netClaveToken.Source != CREDENTIALS_COOKIE {
+					t.Fatalf("source %q, expected %q", netClaveToken.Source, CREDENTIALS_COOKIE)
+				}
+
+				walletIDs = append(walletIDs, netClaveToken.WalletID)
+			}
+
+			if reflect.DeepEqual(walletIDs, test.walletIDs) == false {
+				t.Fatalf("got wallets %v, expected %v", walletIDs, test.walletIDs)
+			}
+
+			if present != test.present {
+				t.Fatalf("present %v, expected %v", present, test.present)
+			}
+		})
+	}
+}
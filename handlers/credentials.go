@@ -0,0 +1,352 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/netclave/common/cryptoutils"
+	"github.com/netclave/common/storage"
+	"github.com/netclave/proxy/component"
+	"github.com/netclave/proxy/config"
+)
+
+const CREDENTIALS_COOKIE = "cookie"
+const CREDENTIALS_HEADER = "header"
+const CREDENTIALS_QUERY = "query"
+
+const AUTHORIZATION_SCHEME = "NetClave"
+
+var useOnceMutex sync.Mutex
+
+// extractNetClaveTokens collects the NetClave tokens of a request from its
+// cookies, from an "Authorization: NetClave <identityProviderID>=<value>"
+// header and from netclave-token-<identityProviderID> query parameters. The
+// second result reports whether any NetClave credentials were present at all,
+// including malformed ones.
+func extractNetClaveTokens(r *http.Request) ([]*NetClaveToken, bool) {
+	netClaveTokens := []*NetClaveToken{}
+	present := false
+
+	for _, cookie := range r.Cookies() {
+		netClaveToken, err := ParseNetClaveCookie(cookie)
+
+		if err == ErrNotNetClaveCookie {
+			continue
+		}
+
+		present = true
+
+		if err != nil {
+			log.Printf(err.Error())
+			continue
+		}
+
+		netClaveToken.Source = CREDENTIALS_COOKIE
+		netClaveTokens = append(netClaveTokens, netClaveToken)
+	}
+
+	if config.AcceptAuthorizationHeader == true {
+		for _, authorization := range r.Header.Values("Authorization") {
+			credentials, ok := netClaveCredentials(authorization)
+
+			if ok == false {
+				continue
+			}
+
+			present = true
+
+			separator := strings.Index(credentials, "=")
+
+			if separator < 0 {
+				log.Printf("Authorization header in wrong format")
+				continue
+			}
+
+			netClaveToken, err := ParseNetClaveToken(credentials[:separator], credentials[separator+1:])
+
+			if err != nil {
+				log.Printf(err.Error())
+				continue
+			}
+
+			netClaveToken.Source = CREDENTIALS_HEADER
+			netClaveTokens = append(netClaveTokens, netClaveToken)
+		}
+	}
+
+	if config.AcceptQueryParameter == true {
+		for name, values := range r.URL.Query() {
+			if !strings.HasPrefix(name, NETCLAVE_COOKIE_PREFIX) {
+				continue
+			}
+
+			present = true
+
+			for _, value := range values {
+				netClaveToken, err := ParseNetClaveToken(strings.TrimPrefix(name, NETCLAVE_COOKIE_PREFIX), value)
+
+				if err != nil {
+					log.Printf(err.Error())
+					continue
+				}
+
+				netClaveToken.Source = CREDENTIALS_QUERY
+				netClaveTokens = append(netClaveTokens, netClaveToken)
+			}
+		}
+	}
+
+	return netClaveTokens, present
+}
+
+func netClaveCredentials(authorization string) (string, bool) {
+	fields := strings.SplitN(strings.TrimSpace(authorization), " ", 2)
+
+	if len(fields) != 2 || !strings.EqualFold(fields[0], AUTHORIZATION_SCHEME) {
+		return "", false
+	}
+
+	return strings.TrimSpace(fields[1]), true
+}
+
+// stripNetClaveAuthorization removes NetClave credentials from the headers,
+// other authorization schemes are meant for the upstream and are kept.
+func stripNetClaveAuthorization(r *http.Request) {
+	authorizations := r.Header.Values("Authorization")
+
+	r.Header.Del("Authorization")
+
+	for _, authorization := range authorizations {
+		_, ok := netClaveCredentials(authorization)
+
+		if ok == false {
+			r.Header.Add("Authorization", authorization)
+		}
+	}
+}
+
+// stripNetClaveQuery removes NetClave tokens from the query, so they are not
+// forwarded to the upstream and do not end up in its logs. This includes
+// tokens that were not needed because another credential was accepted first.
+func stripNetClaveQuery(u *url.URL) {
+	query := u.Query()
+	stripped := false
+
+	for name := range query {
+		if strings.HasPrefix(name, NETCLAVE_COOKIE_PREFIX) {
+			query.Del(name)
+			stripped = true
+		}
+	}
+
+	if stripped == true {
+		u.RawQuery = query.Encode()
+	}
+}
+
+// verifyNetClaveToken reports whether the token is signed by its wallet, is
+// active and grants access to the host. The wallet key, the token and the
+// services must all come from the identity provider the token names. An
+// error is only returned when the storage can not be read.
+func verifyNetClaveToken(cryptoStorage *cryptoutils.CryptoStorage, dataStorage *storage.GenericStorage,
+	identificators map[string]*cryptoutils.Identificator, netClaveToken *NetClaveToken, host string) (bool, error) {
+	identityProviderID := netClaveToken.IdentityProviderID
+	walletID := netClaveToken.WalletID
+	token := netClaveToken.Token
+	signature := netClaveToken.Signature
+
+	identityProvider, ok := identificators[identityProviderID]
+
+	if ok == false || identityProvider.IdentificatorType != cryptoutils.IDENTIFICATOR_TYPE_IDENTITY_PROVIDER {
+		log.Printf("No identity provider found")
+		return false, nil
+	}
+
+	walletPublicKeyPEM, err := dataStorage.GetKey(component.WALLET_KEYS, identityProviderID+"/"+walletID)
+
+	if err != nil {
+		return false, err
+	}
+
+	if walletPublicKeyPEM == "" {
+		log.Printf("No wallet found for identity provider")
+		return false, nil
+	}
+
+	walletPublicKey, err := cryptoutils.ParseRSAPublicKey(walletPublicKeyPEM)
+
+	if err != nil {
+		log.Printf(err.Error())
+		return false, nil
+	}
+
+	verified, err := cryptoutils.Verify(token, signature, walletPublicKey)
+
+	if err != nil {
+		log.Printf(err.Error())
+		return false, nil
+	}
+
+	if verified == false {
+		log.Printf("Can not verify")
+		return false, nil
+	}
+
+	authorized, err := authorizeWallet(dataStorage, identityProviderID, walletID, token, host)
+
+	if err != nil || authorized == false {
+		return false, err
+	}
+
+	if netClaveToken.Source == CREDENTIALS_QUERY {
+		return consumeQueryToken(dataStorage, netClaveToken)
+	}
+
+	return true, nil
+}
+
+// authorizeWallet reports whether the identity provider issued the active
+// token to the wallet and allows the wallet one of the services matching the
+// host.
+func authorizeWallet(dataStorage *storage.GenericStorage, identityProviderID string, walletID string, token string, host string) (bool, error) {
+	servicesJSON, err := dataStorage.GetKey(component.SERVICES, identityProviderID+"/"+walletID)
+
+	if err != nil {
+		return false, err
+	}
+
+	if servicesJSON == "" {
+		log.Printf("No services for wallet")
+		return false, nil
+	}
+
+	var services []string
+	err = json.Unmarshal([]byte(servicesJSON), &services)
+
+	if err != nil {
+		log.Printf(err.Error())
+		return false, nil
+	}
+
+	okService := false
+
+	for _, service := range services {
+		if matchService(service, host) {
+			okService = true
+			break
+		}
+	}
+
+	if okService == false {
+		log.Printf("No access")
+		return false, nil
+	}
+
+	tokenStorage, err := dataStorage.GetKey(component.TOKENS, identityProviderID+"/"+walletID+"/"+token)
+
+	if err != nil {
+		return false, err
+	}
+
+	if tokenStorage == "" {
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// consumeQueryToken accepts a token passed as a query parameter only once, so
+// a link copied from the address bar or a log can not be replayed.
+func consumeQueryToken(dataStorage *storage.GenericStorage, netClaveToken *NetClaveToken) (bool, error) {
+	key := netClaveToken.IdentityProviderID + "/" + netClaveToken.WalletID + "/" + netClaveToken.Token
+
+	first, err := useOnce(dataStorage, component.QUERY_TOKENS, key, netClaveToken.Token, config.TokenTTL*time.Second)
+
+	if err != nil {
+		return false, err
+	}
+
+	if first == false {
+		log.Printf("Query token already used")
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// useOnce stores the key unless it is already stored and reports whether it
+// was stored now. The storage has no atomic set if absent, so checking and
+// storing are serialised within the process, concurrent requests can not
+// both use the key. Proxies sharing the storage are not serialised with each
+// other.
+func useOnce(dataStorage *storage.GenericStorage, table string, key string, value string, ttl time.Duration) (bool, error) {
+	useOnceMutex.Lock()
+	defer useOnceMutex.Unlock()
+
+	used, err := dataStorage.GetKey(table, key)
+
+	if err != nil {
+		return false, err
+	}
+
+	if used != "" {
+		return false, nil
+	}
+
+	err = dataStorage.SetKey(table, key, value, ttl)
+
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// redirectWithTokenCookie stores a token received as a query parameter in a
+// cookie and redirects to the same address without the parameter. Requests
+// other than GET and HEAD are redirected with 307, so the client repeats the
+// method and body.
+func redirectWithTokenCookie(w http.ResponseWriter, r *http.Request, netClaveToken *NetClaveToken) {
+	cookieName := NETCLAVE_COOKIE_PREFIX + netClaveToken.IdentityProviderID
+
+	redirectURL := *r.URL
+	stripNetClaveQuery(&redirectURL)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     cookieName,
+		Value:    netClaveToken.WalletID + "," + netClaveToken.Token + "," + netClaveToken.Signature,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	code := http.StatusSeeOther
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		code = http.StatusTemporaryRedirect
+	}
+
+	http.Redirect(w, r, redirectURL.RequestURI(), code)
+}
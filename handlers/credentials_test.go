@@ -0,0 +1,271 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/netclave/common/cryptoutils"
+	"github.com/netclave/common/storage"
+	"github.com/netclave/proxy/component"
+)
+
+func TestVerifyNetClaveToken(t *testing.T) {
+	walletKey, err := cryptoutils.GenerateKeyPair()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	walletPublicKey, err := cryptoutils.EncodePublicKeyPEM(walletKey)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signature, err := cryptoutils.Sign("t1", walletKey)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	walletsAndServices := &WalletsAndServices{
+		PublicKeys: map[string]string{"w1": walletPublicKey},
+		Services:   map[string][]string{"w1": {"^app\\.example\\.com$"}},
+	}
+
+	tests := []struct {
+		name     string
+		prepare  func(dataStorage *storage.GenericStorage)
+		token    NetClaveToken
+		host     string
+		expected bool
+	}{
+		{
+			name:     "valid",
+			token:    NetClaveToken{IdentityProviderID: "idpA", WalletID: "w1", Token: "t1", Signature: signature},
+			host:     "app.example.com",
+			expected: true,
+		},
+		{
+			name:  "other identity provider",
+			token: NetClaveToken{IdentityProviderID: "idpB", WalletID: "w1", Token: "t1", Signature: signature},
+			host:  "app.example.com",
+		},
+		{
+			name: "other identity provider with the same wallet",
+			prepare: func(dataStorage *storage.GenericStorage) {
+				StoreWalletsAndServices(dataStorage, "idpB", walletsAndServices)
+			},
+			token: NetClaveToken{IdentityProviderID: "idpB", WalletID: "w1", Token: "t1", Signature: signature},
+			host:  "app.example.com",
+		},
+		{
+			name:  "unknown identity provider",
+			token: NetClaveToken{IdentityProviderID: "idpC", WalletID: "w1", Token: "t1", Signature: signature},
+			host:  "app.example.com",
+		},
+		{
+			name: "missing wallet key",
+			prepare: func(dataStorage *storage.GenericStorage) {
+				dataStorage.DelKey(component.WALLET_KEYS, "idpA/w1")
+			},
+			token: NetClaveToken{IdentityProviderID: "idpA", WalletID: "w1", Token: "t1", Signature: signature},
+			host:  "app.example.com",
+		},
+		{
+			name: "missing services",
+			prepare: func(dataStorage *storage.GenericStorage) {
+				dataStorage.DelKey(component.SERVICES, "idpA/w1")
+			},
+			token: NetClaveToken{IdentityProviderID: "idpA", WalletID: "w1", Token: "t1", Signature: signature},
+			host:  "app.example.com",
+		},
+		{
+			name: "revoked token",
+			prepare: func(dataStorage *storage.GenericStorage) {
+				dataStorage.DelKey(component.TOKENS, "idpA/w1/t1")
+			},
+			token: NetClaveToken{IdentityProviderID: "idpA", WalletID: "w1", Token: "t1", Signature: signature},
+			host:  "app.example.com",
+		},
+		{
+			name:  "other service",
+			token: NetClaveToken{IdentityProviderID: "idpA", WalletID: "w1", Token: "t1", Signature: signature},
+			host:  "admin.example.com",
+		},
+		{
+			name:  "bad signature",
+			token: NetClaveToken{IdentityProviderID: "idpA", WalletID: "w1", Token: "t1", Signature: "c2lnbmF0dXJl"},
+			host:  "app.example.com",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dataStorage := newTestStorage(t)
+
+			err := StoreWalletsAndServices(dataStorage, "idpA", walletsAndServices)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = dataStorage.SetKey(component.TOKENS, "idpA/w1/t1", "t1", 0)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if test.prepare != nil {
+				test.prepare(dataStorage)
+			}
+
+			valid, err := verifyNetClaveToken(nil, dataStorage, identityProviders("idpA", "idpB"), &test.token, test.host)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if valid != test.expected {
+				t.Fatalf("valid %v, expected %v", valid, test.expected)
+			}
+		})
+	}
+}
+
+func TestStripNetClaveQuery(t *testing.T) {
+	tests := []struct {
+		name     string
+		rawQuery string
+		expected string
+	}{
+		{"no query", "", ""},
+		{"no tokens", "b=2&a=1", "b=2&a=1"},
+		{"only token", "netclave-token-idp1=w1,t1,sig", ""},
+		{"token among parameters", "a=1&netclave-token-idp1=w1,t1,sig&b=2", "a=1&b=2"},
+		{"several identity providers", "netclave-token-idp1=x&netclave-token-idp2=y&a=1", "a=1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			u := &url.URL{Path: "/", RawQuery: test.rawQuery}
+
+			stripNetClaveQuery(u)
+
+			if u.RawQuery != test.expected {
+				t.Fatalf("got %q, expected %q", u.RawQuery, test.expected)
+			}
+		})
+	}
+}
+
+func TestRedirectWithTokenCookie(t *testing.T) {
+	tests := []struct {
+		method string
+		code   int
+	}{
+		{http.MethodGet, http.StatusSeeOther},
+		{http.MethodHead, http.StatusSeeOther},
+		{http.MethodPost, http.StatusTemporaryRedirect},
+		{http.MethodPut, http.StatusTemporaryRedirect},
+		{http.MethodDelete, http.StatusTemporaryRedirect},
+	}
+
+	netClaveToken := &NetClaveToken{
+		IdentityProviderID: "idp1",
+		WalletID:           "w1",
+		Token:              "t1",
+		Signature:          "sig",
+	}
+
+	for _, test := range tests {
+		t.Run(test.method, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(test.method, "http://example.com/form?a=1&netclave-token-idp1=w1,t1,sig", nil)
+
+			redirectWithTokenCookie(w, r, netClaveToken)
+
+			if w.Code != test.code {
+				t.Fatalf("status %d, expected %d", w.Code, test.code)
+			}
+
+			if w.Header().Get("Location") != "/form?a=1" {
+				t.Fatalf("redirected to %q", w.Header().Get("Location"))
+			}
+
+			cookies := w.Result().Cookies()
+
+			if len(cookies) != 1 {
+				t.Fatalf("%d cookies set", len(cookies))
+			}
+
+			cookieToken, err := ParseNetClaveCookie(cookies[0])
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if *cookieToken != *netClaveToken {
+				t.Fatalf("cookie holds %+v", cookieToken)
+			}
+		})
+	}
+}
+
+func TestConsumeQueryTokenOnce(t *testing.T) {
+	dataStorage := newTestStorage(t)
+
+	netClaveToken := &NetClaveToken{
+		IdentityProviderID: "idp1",
+		WalletID:           "w1",
+		Token:              "t1",
+	}
+
+	var wg sync.WaitGroup
+	var accepted int32
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			ok, err := consumeQueryToken(dataStorage, netClaveToken)
+
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			if ok == true {
+				atomic.AddInt32(&accepted, 1)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if accepted != 1 {
+		t.Fatalf("query token accepted %d times", accepted)
+	}
+}
@@ -0,0 +1,152 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/netclave/common/jsonutils"
+	"github.com/netclave/common/storage"
+	"github.com/netclave/common/utils"
+	"github.com/netclave/proxy/config"
+)
+
+// ErrorPage is the data available to the error page template.
+type ErrorPage struct {
+	Code      int
+	Title     string
+	Message   string
+	WalletURL string
+}
+
+var defaultErrorTemplate = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Code}} {{.Title}}</title>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{.Message}}</p>
+{{if .WalletURL}}<p>Please open your <a href="{{.WalletURL}}">NetClave Web Wallet</a> and try again.</p>{{end}}
+</body>
+</html>
+`))
+
+var errorMessages = map[int]string{
+	http.StatusUnauthorized:       "This service is protected by NetClave. Please sign in with your Web Wallet.",
+	http.StatusForbidden:          "Your NetClave credentials do not grant access to this service.",
+	http.StatusNotFound:           "There is no service at this address.",
+	http.StatusBadGateway:         "The service behind the proxy could not be reached.",
+	http.StatusServiceUnavailable: "The service behind the proxy is currently unavailable.",
+	http.StatusGatewayTimeout:     "The service behind the proxy did not respond in time.",
+}
+
+// writeError answers with the configured error page. Only generic messages
+// are shown, internal errors are expected to be logged by the caller.
+func writeError(w http.ResponseWriter, r *http.Request, code int) {
+	message, ok := errorMessages[code]
+
+	if ok == false {
+		message = "The request could not be processed."
+	}
+
+	walletURL := ""
+
+	if code == http.StatusUnauthorized || code == http.StatusForbidden {
+		walletURL = config.WalletURL
+	}
+
+	page := &ErrorPage{
+		Code:      code,
+		Title:     http.StatusText(code),
+		Message:   message,
+		WalletURL: walletURL,
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+
+	if code == http.StatusUnauthorized && config.AcceptAuthorizationHeader == true {
+		w.Header().Set("WWW-Authenticate", AUTHORIZATION_SCHEME)
+	}
+
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+
+		response := &jsonutils.Response{
+			Status: page.Message,
+			Code:   fmt.Sprint(code),
+			Data: map[string]string{
+				"walletUrl": page.WalletURL,
+			},
+		}
+
+		err := json.NewEncoder(w).Encode(response)
+
+		if err != nil {
+			log.Println(err.Error())
+		}
+
+		return
+	}
+
+	errorTemplate := defaultErrorTemplate
+
+	if config.ErrorPageTemplate != nil {
+		errorTemplate = config.ErrorPageTemplate
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(code)
+
+	err := errorTemplate.Execute(w, page)
+
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+func wantsJSON(r *http.Request) bool {
+	switch config.ErrorPageFormat {
+	case config.ERROR_PAGE_JSON:
+		return true
+	case config.ERROR_PAGE_HTML:
+		return false
+	}
+
+	accept := r.Header.Get("Accept")
+
+	return strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/html")
+}
+
+// deny registers a failed request for fail2ban and answers with the error
+// page.
+func deny(w http.ResponseWriter, r *http.Request, fail2banDataStorage *storage.GenericStorage, event *utils.Event, code int) {
+	err := RegisterFailure(fail2banDataStorage, event)
+
+	if err != nil {
+		log.Println(err.Error())
+	}
+
+	writeError(w, r, code)
+}
@@ -0,0 +1,295 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/netclave/common/storage"
+	"github.com/netclave/common/utils"
+	"github.com/netclave/proxy/component"
+	"github.com/netclave/proxy/config"
+)
+
+// BanRecord is stored next to the fail2ban entry of utils.StoreBannedIP, so
+// that bans can be listed together with their expiry. Times are in
+// milliseconds since the epoch.
+type BanRecord struct {
+	IP        string
+	BannedAt  int64
+	ExpiresAt int64
+	Reason    string
+}
+
+func containsIP(networks []*net.IPNet, ip string) bool {
+	parsedIP := net.ParseIP(ip)
+
+	if parsedIP == nil {
+		return false
+	}
+
+	for _, network := range networks {
+		if network.Contains(parsedIP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// createEvent returns a fail2ban event for a client IP. Unlike
+// utils.CreateSimpleEvent it expects an address without a port.
+func createEvent(ip string) (*utils.Event, error) {
+	uuid, err := utils.GenerateUUID()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &utils.Event{
+		ID:       uuid,
+		IP:       ip,
+		Priority: "1",
+	}, nil
+}
+
+// IsBanned reports whether the address is denylisted or has an active
+// fail2ban record. Allowlisted addresses are never banned.
+func IsBanned(fail2banDataStorage *storage.GenericStorage, ip string) (bool, error) {
+	if containsIP(config.Fail2BanDenyList, ip) {
+		return true, nil
+	}
+
+	if containsIP(config.Fail2BanAllowList, ip) {
+		return false, nil
+	}
+
+	res, err := fail2banDataStorage.GetKey(utils.FAILED_IPS_TABLE, ip)
+
+	if err != nil {
+		return false, err
+	}
+
+	return res != "", nil
+}
+
+// RegisterFailure records a failed request and bans the address once it has
+// failed Fail2BanMaxFailures times within Fail2BanFindTime milliseconds.
+func RegisterFailure(fail2banDataStorage *storage.GenericStorage, event *utils.Event) error {
+	if event.IP == "" || containsIP(config.Fail2BanAllowList, event.IP) {
+		return nil
+	}
+
+	failuresMutex.Lock()
+	failures, err := countFailure(fail2banDataStorage, event.IP)
+	failuresMutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	if failures < config.Fail2BanMaxFailures {
+		return nil
+	}
+
+	log.Printf("Banning %s after %d failures", event.IP, failures)
+
+	return storeBan(fail2banDataStorage, event, config.Fail2BanTTL, "Too many failed requests")
+}
+
+// failureCount is the number of failures of an address in the window that
+// started at Since, in milliseconds since the epoch.
+type failureCount struct {
+	Count int64
+	Since int64
+}
+
+var failuresMutex sync.Mutex
+
+// countFailure adds a failure to the single counter of the address and
+// returns the failures in the current window. The first failure starts the
+// window, the counter expires Fail2BanFindTime milliseconds later. The storage
+// has no atomic increment, so callers serialise on failuresMutex. Replicas
+// sharing the storage may lose a concurrent increment, which only delays a
+// ban.
+func countFailure(fail2banDataStorage *storage.GenericStorage, ip string) (int64, error) {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	counter := &failureCount{}
+
+	counterJSON, err := fail2banDataStorage.GetKey(component.FAIL2BAN_FAILURES, ip)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if counterJSON != "" {
+		err = json.Unmarshal([]byte(counterJSON), counter)
+
+		if err != nil {
+			log.Println(err.Error())
+		}
+	}
+
+	if counter.Count <= 0 || now-counter.Since >= config.Fail2BanFindTime {
+		counter = &failureCount{
+			Since: now,
+		}
+	}
+
+	counter.Count++
+
+	counterData, err := json.Marshal(counter)
+
+	if err != nil {
+		return 0, err
+	}
+
+	expiration := time.Duration(counter.Since+config.Fail2BanFindTime-now) * time.Millisecond
+
+	err = fail2banDataStorage.SetKey(component.FAIL2BAN_FAILURES, ip, string(counterData), expiration)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return counter.Count, nil
+}
+
+// BanAddress bans an address for ttl milliseconds, regardless of failures.
+func BanAddress(fail2banDataStorage *storage.GenericStorage, ip string, ttl int64, reason string) error {
+	parsedIP := net.ParseIP(ip)
+
+	if parsedIP == nil {
+		return fmt.Errorf("Invalid IP address: %s", ip)
+	}
+
+	if ttl <= 0 {
+		ttl = config.Fail2BanTTL
+	}
+
+	event, err := createEvent(parsedIP.String())
+
+	if err != nil {
+		return err
+	}
+
+	return storeBan(fail2banDataStorage, event, ttl, reason)
+}
+
+func storeBan(fail2banDataStorage *storage.GenericStorage, event *utils.Event, ttl int64, reason string) error {
+	err := utils.StoreBannedIP(fail2banDataStorage, event, ttl)
+
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+
+	record := &BanRecord{
+		IP:        event.IP,
+		BannedAt:  now,
+		ExpiresAt: now + ttl,
+		Reason:    reason,
+	}
+
+	recordJSON, err := json.Marshal(record)
+
+	if err != nil {
+		return err
+	}
+
+	err = fail2banDataStorage.SetKey(component.FAIL2BAN_BANS, event.IP, string(recordJSON), time.Duration(ttl)*time.Millisecond)
+
+	if err != nil {
+		return err
+	}
+
+	return clearFailures(fail2banDataStorage, event.IP)
+}
+
+// UnbanAddress lifts a ban and forgets the failures recorded for the address.
+func UnbanAddress(fail2banDataStorage *storage.GenericStorage, ip string) error {
+	parsedIP := net.ParseIP(ip)
+
+	if parsedIP != nil {
+		ip = parsedIP.String()
+	}
+
+	_, err := fail2banDataStorage.DelKey(utils.FAILED_IPS_TABLE, ip)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = fail2banDataStorage.DelKey(component.FAIL2BAN_BANS, ip)
+
+	if err != nil {
+		return err
+	}
+
+	return clearFailures(fail2banDataStorage, ip)
+}
+
+// ListBans returns the active bans. Bans stored by other code paths through
+// utils.StoreBannedIP have no record and are listed without an expiry.
+func ListBans(fail2banDataStorage *storage.GenericStorage) ([]*BanRecord, error) {
+	result := []*BanRecord{}
+
+	keys, err := fail2banDataStorage.GetKeys(utils.FAILED_IPS_TABLE, "*")
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range keys {
+		ip := strings.TrimPrefix(key, utils.FAILED_IPS_TABLE+"/")
+
+		record := &BanRecord{
+			IP: ip,
+		}
+
+		recordJSON, err := fail2banDataStorage.GetKey(component.FAIL2BAN_BANS, ip)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if recordJSON != "" {
+			err = json.Unmarshal([]byte(recordJSON), record)
+
+			if err != nil {
+				log.Println(err.Error())
+			}
+		}
+
+		result = append(result, record)
+	}
+
+	return result, nil
+}
+
+func clearFailures(fail2banDataStorage *storage.GenericStorage, ip string) error {
+	_, err := fail2banDataStorage.DelKey(component.FAIL2BAN_FAILURES, ip)
+
+	return err
+}
@@ -0,0 +1,174 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package handlers
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/netclave/common/storage"
+	"github.com/netclave/proxy/config"
+)
+
+// setFail2Ban sets the fail2ban limits for a test and restores them after.
+func setFail2Ban(t *testing.T, maxFailures int64, findTime int64) {
+	maxFailuresBefore := config.Fail2BanMaxFailures
+	findTimeBefore := config.Fail2BanFindTime
+	ttlBefore := config.Fail2BanTTL
+
+	t.Cleanup(func() {
+		config.Fail2BanMaxFailures = maxFailuresBefore
+		config.Fail2BanFindTime = findTimeBefore
+		config.Fail2BanTTL = ttlBefore
+	})
+
+	config.Fail2BanMaxFailures = maxFailures
+	config.Fail2BanFindTime = findTime
+	config.Fail2BanTTL = 60000
+}
+
+func registerFailures(t *testing.T, fail2banDataStorage *storage.GenericStorage, ip string, count int) {
+	t.Helper()
+
+	for i := 0; i < count; i++ {
+		event, err := createEvent(ip)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = RegisterFailure(fail2banDataStorage, event)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func assertBanned(t *testing.T, fail2banDataStorage *storage.GenericStorage, ip string, expected bool) {
+	t.Helper()
+
+	banned, err := IsBanned(fail2banDataStorage, ip)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if banned != expected {
+		t.Fatalf("banned %v, expected %v", banned, expected)
+	}
+}
+
+func TestRegisterFailureThreshold(t *testing.T) {
+	fail2banDataStorage := newTestStorage(t)
+
+	setFail2Ban(t, 3, 60000)
+
+	registerFailures(t, fail2banDataStorage, "192.0.2.1", 2)
+	assertBanned(t, fail2banDataStorage, "192.0.2.1", false)
+
+	registerFailures(t, fail2banDataStorage, "192.0.2.2", 2)
+	assertBanned(t, fail2banDataStorage, "192.0.2.2", false)
+
+	registerFailures(t, fail2banDataStorage, "192.0.2.1", 1)
+	assertBanned(t, fail2banDataStorage, "192.0.2.1", true)
+	assertBanned(t, fail2banDataStorage, "192.0.2.2", false)
+
+	err := UnbanAddress(fail2banDataStorage, "192.0.2.1")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the ban cleared the failures
+	registerFailures(t, fail2banDataStorage, "192.0.2.1", 2)
+	assertBanned(t, fail2banDataStorage, "192.0.2.1", false)
+}
+
+func TestRegisterFailureFindTime(t *testing.T) {
+	fail2banDataStorage := newTestStorage(t)
+
+	setFail2Ban(t, 3, 200)
+
+	registerFailures(t, fail2banDataStorage, "192.0.2.1", 2)
+
+	time.Sleep(250 * time.Millisecond)
+
+	registerFailures(t, fail2banDataStorage, "192.0.2.1", 2)
+	assertBanned(t, fail2banDataStorage, "192.0.2.1", false)
+
+	registerFailures(t, fail2banDataStorage, "192.0.2.1", 1)
+	assertBanned(t, fail2banDataStorage, "192.0.2.1", true)
+}
+
+func TestIsBanned(t *testing.T) {
+	fail2banDataStorage := newTestStorage(t)
+
+	allowList, err := config.ParseNetworks([]string{"10.0.0.0/8", "192.0.2.10"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	denyList, err := config.ParseNetworks([]string{"198.51.100.0/24", "192.0.2.10", "2001:db8::/32"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(allowList []*net.IPNet, denyList []*net.IPNet) {
+		config.Fail2BanAllowList = allowList
+		config.Fail2BanDenyList = denyList
+	}(config.Fail2BanAllowList, config.Fail2BanDenyList)
+
+	config.Fail2BanAllowList = allowList
+	config.Fail2BanDenyList = denyList
+
+	for _, ip := range []string{"10.1.2.3", "203.0.113.5"} {
+		err = BanAddress(fail2banDataStorage, ip, 60000, "test")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		ip     string
+		banned bool
+	}{
+		{"allowlisted with a stored ban", "10.1.2.3", false},
+		{"allowlisted without a ban", "10.9.9.9", false},
+		{"denylisted", "198.51.100.7", true},
+		{"denylisted IPv6", "2001:db8::5", true},
+		{"denylist wins over allowlist", "192.0.2.10", true},
+		{"stored ban", "203.0.113.5", true},
+		{"not banned", "203.0.113.6", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assertBanned(t, fail2banDataStorage, test.ip, test.banned)
+		})
+	}
+
+	// failures of allowlisted addresses are not even counted
+	setFail2Ban(t, 1, 60000)
+	registerFailures(t, fail2banDataStorage, "10.9.9.9", 3)
+	assertBanned(t, fail2banDataStorage, "10.9.9.9", false)
+}
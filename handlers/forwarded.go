@@ -0,0 +1,196 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package handlers
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/netclave/proxy/config"
+)
+
+// peerAddress returns the IP of the host directly connected to the proxy.
+func peerAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+func isTrustedProxy(ip string) bool {
+	return containsIP(config.TrustedProxies, ip)
+}
+
+// forwardedFor returns the addresses listed in the X-Forwarded-For headers of
+// the request, from the original client to the last proxy.
+func forwardedFor(r *http.Request) []string {
+	addresses := []string{}
+
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		for _, address := range strings.Split(value, ",") {
+			address = strings.TrimSpace(address)
+
+			if address != "" {
+				addresses = append(addresses, address)
+			}
+		}
+	}
+
+	return addresses
+}
+
+// clientAddress returns the IP of the client that made the request. Headers
+// set by proxies are only honoured when the peer is a trusted proxy, and the
+// X-Forwarded-For chain is walked from the right until the first address that
+// is not a trusted proxy.
+func clientAddress(r *http.Request) string {
+	peer := peerAddress(r)
+
+	if isTrustedProxy(peer) == false {
+		return peer
+	}
+
+	addresses := forwardedFor(r)
+
+	if len(addresses) == 0 {
+		realIP := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP")))
+
+		if realIP != nil {
+			return realIP.String()
+		}
+
+		return peer
+	}
+
+	client := peer
+
+	for i := len(addresses) - 1; i >= 0; i-- {
+		ip := net.ParseIP(addresses[i])
+
+		if ip == nil {
+			break
+		}
+
+		client = ip.String()
+
+		if isTrustedProxy(client) == false {
+			break
+		}
+	}
+
+	return client
+}
+
+// requestProto returns the scheme the client used to reach the proxy.
+func requestProto(r *http.Request) string {
+	if isTrustedProxy(peerAddress(r)) {
+		proto := strings.ToLower(strings.TrimSpace(r.Header.Get("X-Forwarded-Proto")))
+
+		if proto == "http" || proto == "https" {
+			return proto
+		}
+	}
+
+	if r.TLS != nil {
+		return "https"
+	}
+
+	return "http"
+}
+
+// setForwardedHeaders prepares the X-Forwarded-*, X-Real-IP and Forwarded
+// headers for the upstream. Headers of untrusted peers are replaced. The peer
+// itself is not added to X-Forwarded-For, httputil.ReverseProxy appends it,
+// other callers use appendForwardedFor.
+func setForwardedHeaders(r *http.Request) {
+	peer := peerAddress(r)
+	trusted := isTrustedProxy(peer)
+	client := clientAddress(r)
+	proto := requestProto(r)
+
+	host := r.Host
+
+	if trusted == true && r.Header.Get("X-Forwarded-Host") != "" {
+		host = r.Header.Get("X-Forwarded-Host")
+	}
+
+	priorForwarded := r.Header.Values("Forwarded")
+	addresses := forwardedFor(r)
+
+	r.Header.Del("X-Forwarded-For")
+	r.Header.Del("Forwarded")
+
+	if trusted == true {
+		if len(addresses) > 0 {
+			r.Header.Set("X-Forwarded-For", strings.Join(addresses, ", "))
+		}
+
+		for _, forwarded := range priorForwarded {
+			r.Header.Add("Forwarded", forwarded)
+		}
+	}
+
+	r.Header.Add("Forwarded", "for="+forwardedNode(peer)+";host="+quoteForwarded(r.Host)+";proto="+connectionScheme(r))
+
+	r.Header.Set("X-Forwarded-Host", host)
+	r.Header.Set("X-Forwarded-Proto", proto)
+	r.Header.Set("X-Real-IP", client)
+}
+
+// appendForwardedFor adds the peer to X-Forwarded-For, for requests that are
+// not sent through httputil.ReverseProxy.
+func appendForwardedFor(r *http.Request) {
+	peer := peerAddress(r)
+	prior := r.Header.Get("X-Forwarded-For")
+
+	if prior != "" {
+		peer = prior + ", " + peer
+	}
+
+	r.Header.Set("X-Forwarded-For", peer)
+}
+
+func connectionScheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+
+	return "http"
+}
+
+// forwardedNode formats an address as a node of the RFC 7239 Forwarded header.
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return "\"[" + ip + "]\""
+	}
+
+	return ip
+}
+
+func quoteForwarded(value string) string {
+	for _, c := range value {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", c)) {
+			return "\"" + strings.Replace(strings.Replace(value, "\\", "\\\\", -1), "\"", "\\\"", -1) + "\""
+		}
+	}
+
+	return value
+}
@@ -0,0 +1,90 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package handlers
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/netclave/proxy/config"
+)
+
+func TestClientAddress(t *testing.T) {
+	trustedProxies, err := config.ParseNetworks([]string{"10.0.0.0/8", "fd00::/8"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(previous []*net.IPNet) {
+		config.TrustedProxies = previous
+	}(config.TrustedProxies)
+
+	config.TrustedProxies = trustedProxies
+
+	tests := []struct {
+		name          string
+		remoteAddress string
+		forwardedFor  []string
+		realIP        string
+		expected      string
+	}{
+		{"untrusted peer", "203.0.113.7:1234", nil, "", "203.0.113.7"},
+		{"untrusted peer with XFF", "203.0.113.7:1234", []string{"198.51.100.1"}, "", "203.0.113.7"},
+		{"untrusted peer with X-Real-IP", "203.0.113.7:1234", nil, "198.51.100.1", "203.0.113.7"},
+		{"trusted peer without XFF", "10.0.0.1:1234", nil, "", "10.0.0.1"},
+		{"trusted peer with X-Real-IP", "10.0.0.1:1234", nil, "198.51.100.1", "198.51.100.1"},
+		{"trusted peer with malformed X-Real-IP", "10.0.0.1:1234", nil, "unknown", "10.0.0.1"},
+		{"single hop", "10.0.0.1:1234", []string{"198.51.100.1"}, "", "198.51.100.1"},
+		{"XFF wins over X-Real-IP", "10.0.0.1:1234", []string{"198.51.100.1"}, "198.51.100.2", "198.51.100.1"},
+		{"trusted hops skipped", "10.0.0.1:1234", []string{"198.51.100.1, 10.0.0.3", "10.0.0.2"}, "", "198.51.100.1"},
+		{"all hops trusted", "10.0.0.1:1234", []string{"10.0.0.3, 10.0.0.2"}, "", "10.0.0.3"},
+		{"spoofed leftmost entry", "10.0.0.1:1234", []string{"1.2.3.4, 198.51.100.1"}, "", "198.51.100.1"},
+		{"spoofed trusted entry", "10.0.0.1:1234", []string{"10.0.0.9, 198.51.100.1"}, "", "198.51.100.1"},
+		{"IPv6 peer", "[fd00::1]:1234", []string{"2001:db8::1"}, "", "2001:db8::1"},
+		{"IPv6 untrusted peer", "[2001:db8::2]:1234", []string{"2001:db8::1"}, "", "2001:db8::2"},
+		{"IPv6 hops", "10.0.0.1:1234", []string{"2001:db8::1, fd00::2"}, "", "2001:db8::1"},
+		{"IPv6 normalised", "10.0.0.1:1234", []string{"2001:DB8:0::1"}, "", "2001:db8::1"},
+		{"malformed rightmost entry", "10.0.0.1:1234", []string{"198.51.100.1, garbage"}, "", "10.0.0.1"},
+		{"malformed entry behind trusted hop", "10.0.0.1:1234", []string{"garbage, 10.0.0.2"}, "", "10.0.0.2"},
+		{"entry with port", "10.0.0.1:1234", []string{"198.51.100.1:4321"}, "", "10.0.0.1"},
+		{"empty entries", "10.0.0.1:1234", []string{" , 198.51.100.1,,"}, "", "198.51.100.1"},
+		{"peer without port", "10.0.0.1", []string{"198.51.100.1"}, "", "198.51.100.1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "http://example.com/", nil)
+			r.RemoteAddr = test.remoteAddress
+
+			for _, value := range test.forwardedFor {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+
+			if test.realIP != "" {
+				r.Header.Set("X-Real-IP", test.realIP)
+			}
+
+			result := clientAddress(r)
+
+			if result != test.expected {
+				t.Fatalf("clientAddress = %q, expected %q", result, test.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package handlers
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/netclave/common/cryptoutils"
+	"github.com/netclave/proxy/component"
+	"github.com/netclave/proxy/config"
+)
+
+const IDENTITY_HEADERS_PREFIX = "X-Netclave-"
+
+// stripIdentityHeaders removes identity headers sent by the client, only the
+// proxy is allowed to set them.
+func stripIdentityHeaders(header http.Header) {
+	configured := []string{
+		config.IdentityHeaderWallet,
+		config.IdentityHeaderIdentityProvider,
+		config.IdentityHeaderJWT,
+	}
+
+	for _, name := range configured {
+		if name != "" {
+			header.Del(name)
+		}
+	}
+
+	for name := range header {
+		if strings.HasPrefix(http.CanonicalHeaderKey(name), IDENTITY_HEADERS_PREFIX) {
+			delete(header, name)
+		}
+	}
+}
+
+// setIdentityHeaders tells the upstream who made the request.
+func setIdentityHeaders(r *http.Request, netClaveToken *NetClaveToken, host string) error {
+	stripIdentityHeaders(r.Header)
+
+	if config.IdentityHeaderWallet != "" {
+		r.Header.Set(config.IdentityHeaderWallet, netClaveToken.WalletID)
+	}
+
+	if config.IdentityHeaderIdentityProvider != "" {
+		r.Header.Set(config.IdentityHeaderIdentityProvider, netClaveToken.IdentityProviderID)
+	}
+
+	if config.IdentityHeaderJWT != "" {
+		jwt, err := createIdentityJWT(netClaveToken, host)
+
+		if err != nil {
+			return err
+		}
+
+		r.Header.Set(config.IdentityHeaderJWT, jwt)
+	}
+
+	return nil
+}
+
+type identityClaims struct {
+	Issuer             string `json:"iss"`
+	Subject            string `json:"sub"`
+	Audience           string `json:"aud"`
+	IdentityProviderID string `json:"idp"`
+	IssuedAt           int64  `json:"iat"`
+	ExpiresAt          int64  `json:"exp"`
+}
+
+// createIdentityJWT returns a short lived RS256 JWT signed with the proxy key.
+// Upstreams can verify it with the public key of the proxy.
+func createIdentityJWT(netClaveToken *NetClaveToken, host string) (string, error) {
+	privateKey, err := cryptoutils.ParseRSAPrivateKey(component.ComponentPrivateKey)
+
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now().Unix()
+
+	header := map[string]string{
+		"alg": "RS256",
+		"typ": "JWT",
+		"kid": component.ComponentIdentificatorID,
+	}
+
+	claims := &identityClaims{
+		Issuer:             component.ComponentIdentificatorID,
+		Subject:            netClaveToken.WalletID,
+		Audience:           host,
+		IdentityProviderID: netClaveToken.IdentityProviderID,
+		IssuedAt:           now,
+		ExpiresAt:          now + config.IdentityJWTTTL,
+	}
+
+	headerJSON, err := json.Marshal(header)
+
+	if err != nil {
+		return "", err
+	}
+
+	claimsJSON, err := json.Marshal(claims)
+
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+
+	hash := sha256.Sum256([]byte(signingInput))
+
+	signature, err := rsa.SignPKCS1v15(rand.Reader, privateKey, crypto.SHA256, hash[:])
+
+	if err != nil {
+		return "", err
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
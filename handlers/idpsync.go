@@ -0,0 +1,274 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package handlers
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/netclave/common/cryptoutils"
+	"github.com/netclave/proxy/component"
+)
+
+// SyncState describes the sync of a single identity provider. Items is the
+// number of items received by the last successful sync, Errors counts all
+// failed attempts, ConsecutiveErrors the ones since the last success, and
+// Backoff is the delay before the next attempt.
+type SyncState struct {
+	Items             int
+	LastSuccess       time.Time
+	LastAttempt       time.Time
+	LastError         string
+	LastErrorTime     time.Time
+	Errors            int64
+	ConsecutiveErrors int64
+	Backoff           time.Duration
+}
+
+// IdentityProviderSync runs Sync for every identity provider of the proxy in
+// its own goroutine, so an unreachable identity provider only delays itself.
+// Sync returns the number of items it received.
+// Failed attempts are retried with exponential backoff and jitter, from
+// Interval up to MaxBackoff.
+type IdentityProviderSync struct {
+	Name       string
+	Sync       func(identityProvider *cryptoutils.Identificator) (int, error)
+	Interval   func() time.Duration
+	MaxBackoff time.Duration
+
+	mutex   sync.Mutex
+	states  map[string]*SyncState
+	cancels map[string]context.CancelFunc
+}
+
+func NewIdentityProviderSync(name string, syncFunc func(identityProvider *cryptoutils.Identificator) (int, error),
+	interval func() time.Duration, maxBackoff time.Duration) *IdentityProviderSync {
+	return &IdentityProviderSync{
+		Name:       name,
+		Sync:       syncFunc,
+		Interval:   interval,
+		MaxBackoff: maxBackoff,
+		states:     map[string]*SyncState{},
+		cancels:    map[string]context.CancelFunc{},
+	}
+}
+
+// Run starts a worker for every identity provider and keeps the workers in
+// line with the identity providers attached to the proxy until the context is
+// done.
+func (ips *IdentityProviderSync) Run(ctx context.Context) {
+	for ctx.Err() == nil {
+		cryptoStorage := component.CreateCryptoStorage()
+
+		identityProviders, err := cryptoStorage.GetIdentificatorToIdentificatorMap(component.ProxyIdentificator, cryptoutils.IDENTIFICATOR_TYPE_IDENTITY_PROVIDER)
+
+		if err != nil {
+			log.Println(err.Error())
+		} else {
+			ips.update(ctx, identityProviders)
+		}
+
+		Sleep(ctx, ips.Interval())
+	}
+
+	ips.mutex.Lock()
+	defer ips.mutex.Unlock()
+
+	for identityProviderID, cancel := range ips.cancels {
+		cancel()
+		delete(ips.cancels, identityProviderID)
+	}
+}
+
+func (ips *IdentityProviderSync) update(ctx context.Context, identityProviders map[string]*cryptoutils.Identificator) {
+	ips.mutex.Lock()
+	defer ips.mutex.Unlock()
+
+	for identityProviderID, cancel := range ips.cancels {
+		_, ok := identityProviders[identityProviderID]
+
+		if ok == false {
+			cancel()
+			delete(ips.cancels, identityProviderID)
+			delete(ips.states, identityProviderID)
+		}
+	}
+
+	for identityProviderID, identityProvider := range identityProviders {
+		_, ok := ips.cancels[identityProviderID]
+
+		if ok == true {
+			continue
+		}
+
+		workerCtx, cancel := context.WithCancel(ctx)
+
+		ips.cancels[identityProviderID] = cancel
+		ips.states[identityProviderID] = &SyncState{}
+
+		go ips.worker(workerCtx, identityProvider)
+	}
+}
+
+func (ips *IdentityProviderSync) worker(ctx context.Context, identityProvider *cryptoutils.Identificator) {
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	for ctx.Err() == nil {
+		started := time.Now()
+
+		items, err := ips.Sync(identityProvider)
+
+		delay := ips.record(identityProvider.IdentificatorID, started, items, err, random)
+
+		if err != nil {
+			log.Printf("Sync of %s from identity provider %s failed, retrying in %s: %v",
+				ips.Name, identityProvider.IdentificatorID, delay.Round(time.Second), err)
+		}
+
+		Sleep(ctx, delay)
+	}
+}
+
+// record updates the state of the identity provider after an attempt and
+// returns the delay before the next one.
+func (ips *IdentityProviderSync) record(identityProviderID string, started time.Time, items int, err error, random *rand.Rand) time.Duration {
+	ips.mutex.Lock()
+	defer ips.mutex.Unlock()
+
+	state, ok := ips.states[identityProviderID]
+
+	if ok == false {
+		state = &SyncState{}
+	}
+
+	state.LastAttempt = started
+
+	if err == nil {
+		state.Items = items
+		state.LastSuccess = started
+		state.ConsecutiveErrors = 0
+		state.Backoff = 0
+
+		return ips.Interval()
+	}
+
+	state.LastError = err.Error()
+	state.LastErrorTime = started
+	state.Errors++
+	state.ConsecutiveErrors++
+	state.Backoff = backoff(ips.Interval(), ips.MaxBackoff, state.ConsecutiveErrors, random)
+
+	return state.Backoff
+}
+
+// States returns a copy of the state of every identity provider.
+func (ips *IdentityProviderSync) States() map[string]SyncState {
+	ips.mutex.Lock()
+	defer ips.mutex.Unlock()
+
+	states := map[string]SyncState{}
+
+	for identityProviderID, state := range ips.states {
+		states[identityProviderID] = *state
+	}
+
+	return states
+}
+
+// backoff doubles the interval for every consecutive failure after the first
+// up to maxBackoff and picks a random delay in the upper half, so identity
+// providers failing together are not retried in lockstep. The delay never
+// drops below the interval, so failing never speeds up polling.
+func backoff(interval time.Duration, maxBackoff time.Duration, failures int64, random *rand.Rand) time.Duration {
+	if maxBackoff < interval {
+		maxBackoff = interval
+	}
+
+	delay := interval
+
+	for i := int64(1); i < failures && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+
+	lowest := delay / 2
+
+	if lowest < interval {
+		lowest = interval
+	}
+
+	if delay <= lowest {
+		return delay
+	}
+
+	return lowest + time.Duration(random.Int63n(int64(delay-lowest)))
+}
+
+// forEachIdentityProvider calls fetch for all identity providers at the same
+// time. Failures are logged and skipped, an error is only returned when every
+// identity provider failed.
+func forEachIdentityProvider(identityProviders map[string]*cryptoutils.Identificator, fetch func(identityProvider *cryptoutils.Identificator) error) error {
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var lastErr error
+
+	failures := 0
+
+	for _, identityProvider := range identityProviders {
+		wg.Add(1)
+
+		go func(identityProvider *cryptoutils.Identificator) {
+			defer wg.Done()
+
+			err := fetch(identityProvider)
+
+			if err != nil {
+				log.Println("Identity provider " + identityProvider.IdentificatorID + ": " + err.Error())
+
+				mutex.Lock()
+				failures++
+				lastErr = err
+				mutex.Unlock()
+			}
+		}(identityProvider)
+	}
+
+	wg.Wait()
+
+	if failures > 0 && failures == len(identityProviders) {
+		return lastErr
+	}
+
+	return nil
+}
+
+// Sleep waits for the duration unless the context is done first.
+func Sleep(ctx context.Context, duration time.Duration) {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
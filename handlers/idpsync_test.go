@@ -0,0 +1,58 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package handlers
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		name       string
+		interval   time.Duration
+		maxBackoff time.Duration
+		failures   int64
+		lowest     time.Duration
+		highest    time.Duration
+	}{
+		{"first failure keeps the interval", 10 * time.Second, 300 * time.Second, 1, 10 * time.Second, 10 * time.Second},
+		{"second failure", 10 * time.Second, 300 * time.Second, 2, 10 * time.Second, 20 * time.Second},
+		{"third failure", 10 * time.Second, 300 * time.Second, 3, 20 * time.Second, 40 * time.Second},
+		{"fourth failure", 10 * time.Second, 300 * time.Second, 4, 40 * time.Second, 80 * time.Second},
+		{"fifth failure", 10 * time.Second, 300 * time.Second, 5, 80 * time.Second, 160 * time.Second},
+		{"capped", 10 * time.Second, 300 * time.Second, 6, 150 * time.Second, 300 * time.Second},
+		{"stays capped", 10 * time.Second, 300 * time.Second, 100, 150 * time.Second, 300 * time.Second},
+		{"cap below twice the interval", 10 * time.Second, 15 * time.Second, 5, 10 * time.Second, 15 * time.Second},
+		{"cap below the interval", 10 * time.Second, 5 * time.Second, 5, 10 * time.Second, 10 * time.Second},
+	}
+
+	random := rand.New(rand.NewSource(1))
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				delay := backoff(test.interval, test.maxBackoff, test.failures, random)
+
+				if delay < test.lowest || delay > test.highest {
+					t.Fatalf("delay %s, expected between %s and %s", delay, test.lowest, test.highest)
+				}
+			}
+		})
+	}
+}
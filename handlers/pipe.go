@@ -0,0 +1,184 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package handlers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errConnectionTimeout = errors.New("idle timeout or maximum lifetime reached")
+
+var pipesMutex sync.Mutex
+var pipes = map[net.Conn]net.Conn{}
+
+// DrainConnections waits until the websocket and TCP connections being
+// proxied are finished. Those still open when the context is done are closed.
+func DrainConnections(ctx context.Context) {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		pipesMutex.Lock()
+		open := len(pipes)
+		pipesMutex.Unlock()
+
+		if open == 0 {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Printf("Closing %d proxied connections", open)
+
+			pipesMutex.Lock()
+			for client, upstream := range pipes {
+				client.Close()
+				upstream.Close()
+			}
+			pipesMutex.Unlock()
+
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// pipeConnections copies data in both directions until both sides closed, the
+// connections were idle for idleTimeout or open for maxLifetime, a zero
+// duration disabling either limit. A side that closes cleanly has its close
+// passed on as a half close, so the other side can finish sending. Any error,
+// including a timeout, closes both connections.
+func pipeConnections(client net.Conn, clientReader io.Reader, upstream net.Conn, upstreamReader io.Reader,
+	idleTimeout time.Duration, maxLifetime time.Duration) {
+	pipesMutex.Lock()
+	pipes[client] = upstream
+	pipesMutex.Unlock()
+
+	defer func() {
+		pipesMutex.Lock()
+		delete(pipes, client)
+		pipesMutex.Unlock()
+	}()
+
+	lifetime := time.Time{}
+
+	if maxLifetime > 0 {
+		lifetime = time.Now().Add(maxLifetime)
+	}
+
+	activity := time.Now().UnixNano()
+
+	errc := make(chan error, 2)
+
+	go func() {
+		errc <- copyConnection(upstream, client, clientReader, &activity, idleTimeout, lifetime)
+	}()
+	go func() {
+		errc <- copyConnection(client, upstream, upstreamReader, &activity, idleTimeout, lifetime)
+	}()
+
+	err := <-errc
+
+	if err != nil {
+		log.Printf("Connection to %s: %v", upstream.RemoteAddr().String(), err)
+
+		client.Close()
+		upstream.Close()
+	}
+
+	<-errc
+}
+
+// copyConnection copies from src to dst until src is closed. The read deadline
+// follows the last activity in either direction, so a connection carrying
+// data only one way is not considered idle.
+func copyConnection(dst net.Conn, src net.Conn, reader io.Reader, activity *int64, idleTimeout time.Duration, lifetime time.Time) error {
+	buffer := make([]byte, 32*1024)
+
+	for {
+		src.SetReadDeadline(connectionDeadline(activity, idleTimeout, lifetime))
+
+		n, err := reader.Read(buffer)
+
+		if n > 0 {
+			atomic.StoreInt64(activity, time.Now().UnixNano())
+
+			_, writeErr := dst.Write(buffer[:n])
+
+			if writeErr != nil {
+				return writeErr
+			}
+		}
+
+		if err == nil {
+			continue
+		}
+
+		if err == io.EOF {
+			closeWrite(dst)
+			return nil
+		}
+
+		var netErr net.Error
+
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			deadline := connectionDeadline(activity, idleTimeout, lifetime)
+
+			if deadline.IsZero() == false && time.Now().Before(deadline) {
+				continue
+			}
+
+			return errConnectionTimeout
+		}
+
+		return err
+	}
+}
+
+// connectionDeadline is the time the connection expires at, the zero time
+// when neither an idle timeout nor a maximum lifetime is configured.
+func connectionDeadline(activity *int64, idleTimeout time.Duration, lifetime time.Time) time.Time {
+	deadline := lifetime
+
+	if idleTimeout > 0 {
+		idle := time.Unix(0, atomic.LoadInt64(activity)).Add(idleTimeout)
+
+		if deadline.IsZero() || idle.Before(deadline) {
+			deadline = idle
+		}
+	}
+
+	return deadline
+}
+
+func closeWrite(conn net.Conn) {
+	halfCloser, ok := conn.(interface{ CloseWrite() error })
+
+	if ok == false {
+		conn.Close()
+		return
+	}
+
+	halfCloser.CloseWrite()
+}
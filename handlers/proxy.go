@@ -17,10 +17,8 @@
 package handlers
 
 import (
-	"crypto/tls"
-	"encoding/json"
-	"fmt"
-	"io"
+	"context"
+	"errors"
 	"log"
 	"net"
 	"net/http"
@@ -28,33 +26,148 @@ import (
 	"net/url"
 	"regexp"
 	"strings"
-	"time"
+	"sync"
+	"sync/atomic"
 
+	"github.com/netclave/proxy/balancer"
 	"github.com/netclave/proxy/config"
 
-	"github.com/netclave/common/cryptoutils"
-	"github.com/netclave/common/networkutils"
-	"github.com/netclave/common/utils"
 	"github.com/netclave/proxy/component"
 )
 
+// Handle proxies requests by the routing table it holds. The table can be
+// replaced with SetRoutes while requests are served, every request uses the
+// table it started with. Tokens of identity providers the SyncMonitor rejects
+// as stale are not accepted.
 type Handle struct {
-	Rules     map[string][]map[string]string
-	TLSConfig *tls.Config
-	Dialer    *net.Dialer
+	SyncMonitor *SyncMonitor
+
+	state atomic.Value
+}
+
+type handleState struct {
+	routes  *config.RoutingTable
+	proxies map[*config.PathRoute]*httputil.ReverseProxy
+}
+
+type backendContextKey struct{}
+
+// NewHandle creates the proxy handler for the routing table with one reverse
+// proxy per path route, sharing the route's upstream transport.
+func NewHandle(routes *config.RoutingTable) *Handle {
+	hd := &Handle{}
+	hd.SetRoutes(routes)
+
+	return hd
+}
+
+// SetRoutes atomically replaces the routing table.
+func (hd *Handle) SetRoutes(routes *config.RoutingTable) {
+	proxies := map[*config.PathRoute]*httputil.ReverseProxy{}
+
+	for _, hostRoute := range routes.Hosts {
+		for _, pathRoute := range hostRoute.Paths {
+			proxies[pathRoute] = newReverseProxy(pathRoute)
+		}
+	}
+
+	hd.state.Store(&handleState{
+		routes:  routes,
+		proxies: proxies,
+	})
+}
+
+// Routes returns the routing table in use.
+func (hd *Handle) Routes() *config.RoutingTable {
+	return hd.state.Load().(*handleState).routes
+}
+
+// newReverseProxy creates the reverse proxy of a path route. The backend is
+// picked per request and passed to it in the request context.
+func newReverseProxy(pathRoute *config.PathRoute) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Transport:     pathRoute.Transport,
+		FlushInterval: pathRoute.FlushInterval,
+		Director: func(r *http.Request) {
+			backend := r.Context().Value(backendContextKey{}).(*balancer.Backend)
+
+			directRequest(r, backend.URL)
+
+			if _, ok := r.Header["User-Agent"]; ok == false {
+				r.Header.Set("User-Agent", "")
+			}
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			backend := r.Context().Value(backendContextKey{}).(*balancer.Backend)
+
+			log.Printf("Upstream %s: %v", backend.URL.String(), err)
+
+			if r.Context().Err() == nil {
+				pathRoute.Pool.MarkFailed(backend, err)
+			}
+
+			writeError(w, r, upstreamErrorCode(err))
+		},
+	}
+}
+
+// directRequest points the request at the target upstream, appending the
+// request path and query to the ones of the upstream URL.
+func directRequest(r *http.Request, target *url.URL) {
+	r.URL.Scheme = target.Scheme
+	r.URL.Host = target.Host
+	r.URL.Path = joinPaths(target.Path, r.URL.Path)
+
+	if target.RawQuery == "" || r.URL.RawQuery == "" {
+		r.URL.RawQuery = target.RawQuery + r.URL.RawQuery
+	} else {
+		r.URL.RawQuery = target.RawQuery + "&" + r.URL.RawQuery
+	}
+
+	r.Host = target.Host
+}
+
+func joinPaths(base string, path string) string {
+	baseSlash := strings.HasSuffix(base, "/")
+	pathSlash := strings.HasPrefix(path, "/")
+
+	switch {
+	case baseSlash && pathSlash:
+		return base + path[1:]
+	case !baseSlash && !pathSlash:
+		return base + "/" + path
+	}
+
+	return base + path
 }
 
 func (hd *Handle) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	state := hd.state.Load().(*handleState)
+
 	cryptoStorage := component.CreateCryptoStorage()
 	dataStorage := component.CreateDataStorage()
 
 	fail2banDataStorage := component.CreateFail2BanDataStorage()
 
-	event, err := utils.CreateSimpleEvent(networkutils.GetRemoteAddress(r))
+	event, err := createEvent(clientAddress(r))
+
+	if err != nil {
+		log.Printf(err.Error())
+		writeError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	banned, err := IsBanned(fail2banDataStorage, event.IP)
 
 	if err != nil {
 		log.Printf(err.Error())
-		http.Error(w, err.Error(), 500)
+		writeError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	if banned == true {
+		log.Printf("Banned address: %s", event.IP)
+		writeError(w, r, config.Fail2BanStatusCode)
 		return
 	}
 
@@ -63,338 +176,161 @@ func (hd *Handle) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	log.Println(host + " " + path)
 
-	var chosenHostRules []map[string]string
-	ok := false
-
-	for key, value := range hd.Rules {
-		re := regexp.MustCompile(key)
-		result := re.FindString(host)
+	chosenHostRoute := state.routes.MatchHost(host)
+	ok := chosenHostRoute != nil
 
-		if result != "" {
-			chosenHostRules = value
-			ok = true
-			break
-		}
+	if ok == false {
+		log.Printf("No rule found")
+		deny(w, r, fail2banDataStorage, event, http.StatusNotFound)
+		return
 	}
 
-	if ok == false {
-		err = utils.StoreBannedIP(fail2banDataStorage, event, config.Fail2BanTTL)
-		if err != nil {
-			log.Printf(err.Error())
-			http.Error(w, err.Error(), 500)
-			return
-		}
+	pathRoute := chosenHostRoute.MatchPath(path)
+	proxyOK := pathRoute != nil
 
+	if proxyOK == false {
 		log.Printf("No rule found")
-		http.Error(w, "No rule found", 500)
+		deny(w, r, fail2banDataStorage, event, http.StatusNotFound)
+		return
+	}
+
+	identificators, err := cryptoStorage.GetIdentificators()
+
+	if err != nil {
+		log.Printf(err.Error())
+		writeError(w, r, http.StatusInternalServerError)
 		return
 	}
 
-	proxyURL := ""
-	proxyOK := false
+	netClaveTokens, hasNetClaveCredentials := extractNetClaveTokens(r)
+	var verifiedToken *NetClaveToken
 
-	for _, rule := range chosenHostRules {
-		for from, to := range rule {
-			re := regexp.MustCompile(from)
-			result := re.FindString(path)
+	for _, netClaveToken := range netClaveTokens {
+		if hd.SyncMonitor != nil && hd.SyncMonitor.Reject(netClaveToken.IdentityProviderID) == true {
+			continue
+		}
 
-			if result != "" {
-				proxyURL = to
-				proxyOK = true
-				break
-			}
+		valid, err := verifyNetClaveToken(cryptoStorage, dataStorage, identificators, netClaveToken, host)
+
+		if err != nil {
+			log.Printf(err.Error())
+			writeError(w, r, http.StatusInternalServerError)
+			return
 		}
 
-		if proxyOK == true {
+		if valid == true {
+			verifiedToken = netClaveToken
 			break
 		}
 	}
 
-	if proxyOK == false {
-		err = utils.StoreBannedIP(fail2banDataStorage, event, config.Fail2BanTTL)
-		if err != nil {
-			log.Printf(err.Error())
-			http.Error(w, err.Error(), 500)
+	if verifiedToken == nil {
+		log.Printf("No access")
+
+		if hasNetClaveCredentials == false {
+			deny(w, r, fail2banDataStorage, event, http.StatusUnauthorized)
 			return
 		}
 
-		log.Printf("No rule found")
-		http.Error(w, "No rule found", 500)
+		deny(w, r, fail2banDataStorage, event, http.StatusForbidden)
 		return
 	}
 
-	identificators, err := cryptoStorage.GetIdentificators()
-
-	if err != nil {
-		log.Printf(err.Error())
-		http.Error(w, err.Error(), 500)
+	if verifiedToken.Source == CREDENTIALS_QUERY {
+		redirectWithTokenCookie(w, r, verifiedToken)
 		return
 	}
 
-	for key, identificator := range identificators {
-		log.Println(key + " " + identificator.IdentificatorID + " " + identificator.IdentificatorType + " " + identificator.IdentificatorURL)
+	if len(config.TCPProxies) > 0 {
+		err = storeIPSession(dataStorage, event.IP, verifiedToken)
+
+		if err != nil {
+			log.Printf(err.Error())
+		}
 	}
 
-	hasValidNetClaveCookie := false
+	stripNetClaveAuthorization(r)
+	stripNetClaveQuery(r.URL)
 
-	for k, v := range r.Header {
-		if strings.ToLower(k) == "cookie" {
-			for _, cookies := range v {
-				cookiesTokens := strings.Split(cookies, ";")
-				for _, cookie := range cookiesTokens {
-					trimmedCookie := strings.Trim(cookie, " ")
-					log.Println(trimmedCookie)
-					cookieTokens := strings.Split(trimmedCookie, "=")
-					cookieValue := ""
-					if len(cookieTokens) > 2 {
-						for i, token := range cookieTokens {
-							if i > 1 {
-								cookieValue = cookieValue + "=" + token
-							} else {
-								if i == 1 {
-									cookieValue = cookieValue + token
-								}
-							}
-						}
-					} else {
-						cookieValue = cookieTokens[1]
-					}
+	err = setIdentityHeaders(r, verifiedToken, host)
 
-					identityProviderID := cookieTokens[0]
+	if err != nil {
+		log.Printf(err.Error())
+		writeError(w, r, http.StatusInternalServerError)
+		return
+	}
 
-					log.Println(identityProviderID)
-					log.Println(cookieValue)
+	r.URL.Path = pathRoute.RewritePath(r.URL.Path)
+	r.URL.RawPath = ""
 
-					netClaveSuffix := "netclave-token-"
+	backend, err := pathRoute.Pool.Next(verifiedToken.WalletID)
 
-					if !strings.Contains(identityProviderID, netClaveSuffix) {
-						continue
-					}
-
-					identityProviderID = strings.Replace(identityProviderID, netClaveSuffix, "", -1)
+	if err != nil {
+		log.Printf(err.Error())
+		writeError(w, r, http.StatusServiceUnavailable)
+		return
+	}
 
-					log.Println(identityProviderID)
-
-					cookieValueTokens := strings.Split(cookieValue, ",")
-
-					if len(cookieValueTokens) != 3 {
-						log.Printf("Cookie in wrong format")
-						continue
-					}
-
-					walletID := cookieValueTokens[0]
-					token := cookieValueTokens[1]
-					signature := cookieValueTokens[2]
-
-					_, ok := identificators[identityProviderID]
-
-					if ok == false {
-						log.Printf("No identity provider found")
-						continue
-					}
-
-					_, ok = identificators[walletID]
-
-					if ok == false {
-						log.Printf("No wallet found")
-						continue
-					}
-
-					walletPublicKeyPEM, err := cryptoStorage.RetrievePublicKey(walletID)
-
-					if err != nil {
-						log.Printf(err.Error())
-						continue
-					}
-
-					walletPublicKey, err := cryptoutils.ParseRSAPublicKey(walletPublicKeyPEM)
-
-					if err != nil {
-						log.Printf(err.Error())
-						continue
-					}
-
-					log.Println(token + " " + signature)
-
-					verified, err := cryptoutils.Verify(token, signature, walletPublicKey)
-
-					if err != nil {
-						log.Printf(err.Error())
-						continue
-					}
-
-					if verified == false {
-						log.Printf("Can not verify")
-						continue
-					}
-
-					log.Println("After verify")
-
-					servicesJSON, err := dataStorage.GetKey(component.SERVICES, walletID)
-					if err != nil {
-						err = utils.StoreBannedIP(fail2banDataStorage, event, config.Fail2BanTTL)
-						if err != nil {
-							log.Printf(err.Error())
-							http.Error(w, err.Error(), 500)
-							return
-						}
-
-						log.Printf(err.Error())
-						http.Error(w, err.Error(), 500)
-						return
-					}
-
-					log.Println(servicesJSON)
-
-					var services []string
-					err = json.Unmarshal([]byte(servicesJSON), &services)
+	backend.Acquire()
+	defer backend.Release()
 
-					if err != nil {
-						log.Printf(err.Error())
-						continue
-					}
+	setForwardedHeaders(r)
 
-					okService := false
+	if isWebSocketUpgrade(r) == true {
+		proxyWebSocket(w, r, pathRoute, backend)
+		return
+	}
 
-					for _, service := range services {
-						log.Println(service)
-						re := regexp.MustCompile(service)
-						result := re.FindString(host)
+	log.Println(r.Method)
 
-						if result != "" {
-							okService = true
-							break
-						}
-					}
+	proxy, ok := state.proxies[pathRoute]
 
-					if okService == false {
-						log.Printf("No access")
-						continue
-					}
+	if ok == false {
+		proxy = newReverseProxy(pathRoute)
+	}
 
-					tokenStorage, err := dataStorage.GetKey(component.TOKENS, walletID+"/"+token)
-					if err != nil {
-						log.Printf(err.Error())
-						continue
-					}
-
-					if tokenStorage == "" {
-						continue
-					}
+	proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), backendContextKey{}, backend)))
+}
 
-					hasValidNetClaveCookie = true
-					break
-				}
-			}
-		}
+// upstreamErrorCode tells a backend that did not answer in time from one
+// that could not be reached at all.
+func upstreamErrorCode(err error) int {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout
 	}
 
-	if hasValidNetClaveCookie == false {
-		err = utils.StoreBannedIP(fail2banDataStorage, event, config.Fail2BanTTL)
-		if err != nil {
-			log.Printf(err.Error())
-			http.Error(w, err.Error(), 500)
-			return
-		}
+	var netErr net.Error
 
-		log.Printf("No access")
-		http.Error(w, "No access", 500)
-		return
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return http.StatusGatewayTimeout
 	}
 
-	hj, isHJ := w.(http.Hijacker)
-	if r.Header.Get("Upgrade") == "websocket" && isHJ {
-		c, br, err := hj.Hijack()
-		if err != nil {
-			err = utils.StoreBannedIP(fail2banDataStorage, event, config.Fail2BanTTL)
-			if err != nil {
-				log.Printf(err.Error())
-				http.Error(w, err.Error(), 500)
-				return
-			}
+	return http.StatusBadGateway
+}
 
-			log.Printf("websocket websocket hijack: %v", err)
-			http.Error(w, err.Error(), 500)
-			return
-		}
-		defer c.Close()
+var servicePatterns sync.Map
 
-		var be net.Conn
+// matchService reports whether a wallet service pattern matches the host.
+// Patterns come from the identity providers, so they are compiled lazily and
+// cached, and an invalid pattern is logged and never matches.
+func matchService(service string, host string) bool {
+	cached, ok := servicePatterns.Load(service)
 
-		withoutProtocol := strings.Replace(proxyURL, "http://", "", -1)
-		withoutProtocol = strings.Replace(withoutProtocol, "https://", "", -1)
+	if ok == false {
+		re, err := regexp.Compile(service)
 
-		if strings.Contains(proxyURL, "https") {
-			be, err = tls.DialWithDialer(hd.Dialer, "tcp", withoutProtocol, hd.TLSConfig)
-		} else {
-			be, err = net.DialTimeout("tcp", withoutProtocol, 30*time.Second)
-		}
 		if err != nil {
-			err = utils.StoreBannedIP(fail2banDataStorage, event, config.Fail2BanTTL)
-			if err != nil {
-				log.Printf(err.Error())
-				http.Error(w, err.Error(), 500)
-				return
-			}
-
-			log.Printf("websocket Dial: %v", err)
-			http.Error(w, err.Error(), 500)
-			return
+			log.Printf("Invalid service pattern %q: %v", service, err)
 		}
-		defer be.Close()
-		if err := r.Write(be); err != nil {
-			err = utils.StoreBannedIP(fail2banDataStorage, event, config.Fail2BanTTL)
-			if err != nil {
-				log.Printf(err.Error())
-				http.Error(w, err.Error(), 500)
-				return
-			}
 
-			log.Printf("websocket backend write request: %v", err)
-			http.Error(w, err.Error(), 500)
-			return
-		}
-		errc := make(chan error, 1)
-		go func() {
-			n, err := io.Copy(be, br) // backend <- buffered reader
-			if err != nil {
-				err = fmt.Errorf("websocket: to copy backend from buffered reader: %v, %v", n, err)
-			}
-			errc <- err
-		}()
-		go func() {
-			n, err := io.Copy(c, be) // raw conn <- backend
-			if err != nil {
-				err = fmt.Errorf("websocket: to raw conn from backend: %v, %v", n, err)
-			}
-			errc <- err
-		}()
-		if err := <-errc; err != nil {
-			log.Print(err)
-		}
-		return
+		cached, _ = servicePatterns.LoadOrStore(service, re)
 	}
 
-	log.Println(r.Method)
-
-	url, err := url.Parse(proxyURL)
-	if err != nil {
-		err = utils.StoreBannedIP(fail2banDataStorage, event, config.Fail2BanTTL)
-		if err != nil {
-			log.Printf(err.Error())
-			http.Error(w, err.Error(), 500)
-			return
-		}
+	re := cached.(*regexp.Regexp)
 
-		log.Printf("Can not parse url: %v", err)
-		http.Error(w, err.Error(), 500)
-		return
+	if re == nil {
+		return false
 	}
 
-	proxy := httputil.NewSingleHostReverseProxy(url)
-	r.URL.Host = url.Host
-	r.URL.Scheme = url.Scheme
-	r.Header.Set("X-Forwarded-Host", r.Header.Get("Host"))
-	r.Host = url.Host
-	proxy.ServeHTTP(w, r)
+	return re.FindString(host) != ""
 }
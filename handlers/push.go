@@ -0,0 +1,240 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/netclave/common/cryptoutils"
+	"github.com/netclave/common/jsonutils"
+	"github.com/netclave/proxy/component"
+	"github.com/netclave/proxy/config"
+)
+
+const PUSH_PATH = "/push"
+
+// PushMessage is what an identity provider posts to the push endpoint, signed
+// with its key and encrypted for the proxy like its answers to the sync
+// requests. Timestamp, in milliseconds, and Nonce protect against replays.
+// Tokens holds issued and revoked tokens, Wallets new or changed wallets and
+// RemovedWallets the wallets whose access is withdrawn.
+type PushMessage struct {
+	Timestamp      int64               `json:"timestamp"`
+	Nonce          string              `json:"nonce"`
+	Tokens         *TokenChanges       `json:"tokens"`
+	Wallets        *WalletsAndServices `json:"wallets"`
+	RemovedWallets []string            `json:"removedWallets"`
+}
+
+// PushHandler receives changes pushed by identity providers so they take
+// effect without waiting for the next sync.
+type PushHandler struct {
+	TokenSync *TokenSync
+}
+
+func (ph *PushHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fail2banDataStorage := component.CreateFail2BanDataStorage()
+
+	event, err := createEvent(peerAddress(r))
+
+	if err != nil {
+		log.Println(err.Error())
+		writePushResponse(w, http.StatusInternalServerError, nil)
+		return
+	}
+
+	banned, err := IsBanned(fail2banDataStorage, event.IP)
+
+	if err != nil {
+		log.Println(err.Error())
+		writePushResponse(w, http.StatusInternalServerError, nil)
+		return
+	}
+
+	if banned == true {
+		writePushResponse(w, config.Fail2BanStatusCode, nil)
+		return
+	}
+
+	if r.URL.Path != PUSH_PATH || r.Method != http.MethodPost {
+		writePushResponse(w, http.StatusNotFound, nil)
+		return
+	}
+
+	cryptoStorage := component.CreateCryptoStorage()
+
+	identityProvider, message, err := readPushMessage(cryptoStorage, r)
+
+	if err != nil {
+		log.Println("Rejected push: " + err.Error())
+
+		err = RegisterFailure(fail2banDataStorage, event)
+
+		if err != nil {
+			log.Println(err.Error())
+		}
+
+		writePushResponse(w, http.StatusForbidden, nil)
+		return
+	}
+
+	dataStorage := component.CreateDataStorage()
+
+	if message.Wallets != nil {
+		err = StoreWalletsAndServices(dataStorage, identityProvider.IdentificatorID, message.Wallets)
+
+		if err != nil {
+			writePushResponse(w, http.StatusInternalServerError, nil)
+			return
+		}
+	}
+
+	err = RemoveWallets(dataStorage, identityProvider.IdentificatorID, message.RemovedWallets)
+
+	if err != nil {
+		log.Println(err.Error())
+		writePushResponse(w, http.StatusInternalServerError, nil)
+		return
+	}
+
+	if message.Tokens != nil {
+		ph.TokenSync.Apply(identityProvider.IdentificatorID, message.Tokens)
+
+		identityProviders, err := cryptoStorage.GetIdentificatorToIdentificatorMap(component.ProxyIdentificator, cryptoutils.IDENTIFICATOR_TYPE_IDENTITY_PROVIDER)
+
+		if err == nil {
+			err = ph.TokenSync.Store(dataStorage, identityProviders)
+		}
+
+		if err != nil {
+			log.Println(err.Error())
+			writePushResponse(w, http.StatusInternalServerError, nil)
+			return
+		}
+	}
+
+	log.Println("Applied push from identity provider " + identityProvider.IdentificatorID)
+
+	response, err := jsonutils.SignAndEncryptResponse("OK", component.ComponentIdentificatorID,
+		component.ComponentPrivateKey, component.ComponentPublicKey, identityProvider.PublicKey, false)
+
+	if err != nil {
+		log.Println(err.Error())
+		writePushResponse(w, http.StatusInternalServerError, nil)
+		return
+	}
+
+	writePushResponse(w, http.StatusOK, response)
+}
+
+type pushSender struct {
+	IdentificatorID string
+	PublicKey       string
+}
+
+// readPushMessage verifies that the message was signed by an identity
+// provider attached to the proxy, with the key stored when it was confirmed,
+// and that it is recent and not a replay.
+func readPushMessage(cryptoStorage *cryptoutils.CryptoStorage, r *http.Request) (*pushSender, *PushMessage, error) {
+	request, err := jsonutils.ParseRequest(r)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// never trust a key sent along with the message
+	request.PublicKey = ""
+
+	response, identityProviderID, err := jsonutils.VerifyAndDecrypt(request, component.ComponentPrivateKey, cryptoStorage)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	identityProviders, err := cryptoStorage.GetIdentificatorToIdentificatorMap(component.ProxyIdentificator, cryptoutils.IDENTIFICATOR_TYPE_IDENTITY_PROVIDER)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	_, ok := identityProviders[identityProviderID]
+
+	if ok == false {
+		return nil, nil, errors.New("Unknown identity provider " + identityProviderID)
+	}
+
+	publicKey, err := cryptoStorage.RetrievePublicKey(identityProviderID)
+
+	if err != nil || publicKey == "" {
+		return nil, nil, errors.New("No public key for identity provider " + identityProviderID)
+	}
+
+	message := &PushMessage{}
+
+	err = json.Unmarshal([]byte(response), message)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	age := time.Since(time.Unix(0, message.Timestamp*int64(time.Millisecond)))
+	maxAge := time.Duration(config.PushMaxAge) * time.Second
+
+	if age > maxAge || age < -maxAge {
+		return nil, nil, errors.New("Push message expired")
+	}
+
+	if message.Nonce == "" {
+		return nil, nil, errors.New("Push message without nonce")
+	}
+
+	dataStorage := component.CreateDataStorage()
+
+	nonceKey := identityProviderID + "/" + message.Nonce
+
+	first, err := useOnce(dataStorage, component.PUSH_NONCES, nonceKey, message.Nonce, 2*maxAge)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if first == false {
+		return nil, nil, errors.New("Push message replayed")
+	}
+
+	return &pushSender{
+		IdentificatorID: identityProviderID,
+		PublicKey:       publicKey,
+	}, message, nil
+}
+
+func writePushResponse(w http.ResponseWriter, code int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+
+	json.NewEncoder(w).Encode(&jsonutils.Response{
+		Status: http.StatusText(code),
+		Code:   strconv.Itoa(code),
+		Data:   data,
+	})
+}
@@ -0,0 +1,212 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/netclave/common/cryptoutils"
+	"github.com/netclave/common/jsonutils"
+	"github.com/netclave/proxy/component"
+	"github.com/netclave/proxy/config"
+)
+
+type pushKey struct {
+	privateKey string
+	publicKey  string
+}
+
+func newPushKey(t *testing.T) *pushKey {
+	t.Helper()
+
+	pair, err := cryptoutils.GenerateKeyPair()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publicKey, err := cryptoutils.EncodePublicKeyPEM(pair)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	privateKey, err := cryptoutils.EncodePrivateKeyPEM(pair)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &pushKey{
+		privateKey: privateKey,
+		publicKey:  publicKey,
+	}
+}
+
+// setupPush creates the proxy's key and an identity provider attached to
+// the proxy with the key returned, and one only known to the crypto storage.
+func setupPush(t *testing.T) (*cryptoutils.CryptoStorage, *pushKey, *pushKey) {
+	newTestStorage(t)
+
+	proxyKey := newPushKey(t)
+
+	component.ComponentIdentificatorID = "proxy"
+	component.ComponentPrivateKey = proxyKey.privateKey
+	component.ComponentPublicKey = proxyKey.publicKey
+	component.ProxyIdentificator = &cryptoutils.Identificator{
+		IdentificatorID:   "proxy",
+		IdentificatorType: cryptoutils.IDENTIFICATOR_TYPE_PROXY,
+	}
+
+	config.PushMaxAge = 60
+
+	cryptoStorage := component.CreateCryptoStorage()
+
+	keys := []*pushKey{}
+
+	for _, id := range []string{"idp1", "idp2"} {
+		key := newPushKey(t)
+		keys = append(keys, key)
+
+		identityProvider := &cryptoutils.Identificator{
+			IdentificatorID:   id,
+			IdentificatorType: cryptoutils.IDENTIFICATOR_TYPE_IDENTITY_PROVIDER,
+		}
+
+		err := cryptoStorage.AddIdentificator(identityProvider)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = cryptoStorage.StorePublicKey(id, key.publicKey)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if id == "idp1" {
+			err = cryptoStorage.AddIdentificatorToIdentificator(component.ProxyIdentificator, identityProvider)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	return cryptoStorage, keys[0], keys[1]
+}
+
+func pushRequest(t *testing.T, id string, key *pushKey, message *PushMessage) []byte {
+	t.Helper()
+
+	request, err := jsonutils.SignAndEncryptResponse(message, id, key.privateKey, key.publicKey, component.ComponentPublicKey, true)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := json.Marshal(request)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return body
+}
+
+func readPush(cryptoStorage *cryptoutils.CryptoStorage, body []byte) error {
+	_, _, err := readPushMessage(cryptoStorage, httptest.NewRequest("POST", PUSH_PATH, bytes.NewReader(body)))
+
+	return err
+}
+
+func pushTimestamp(offset time.Duration) int64 {
+	return time.Now().Add(offset).UnixNano() / int64(time.Millisecond)
+}
+
+func TestReadPushMessage(t *testing.T) {
+	cryptoStorage, idp1Key, idp2Key := setupPush(t)
+	otherKey := newPushKey(t)
+
+	tests := []struct {
+		name    string
+		id      string
+		key     *pushKey
+		message *PushMessage
+		valid   bool
+	}{
+		{"valid", "idp1", idp1Key, &PushMessage{Timestamp: pushTimestamp(0), Nonce: "n1"}, true},
+		{"bad signature", "idp1", otherKey, &PushMessage{Timestamp: pushTimestamp(0), Nonce: "n2"}, false},
+		{"stale timestamp", "idp1", idp1Key, &PushMessage{Timestamp: pushTimestamp(-2 * time.Minute), Nonce: "n3"}, false},
+		{"future timestamp", "idp1", idp1Key, &PushMessage{Timestamp: pushTimestamp(2 * time.Minute), Nonce: "n4"}, false},
+		{"missing nonce", "idp1", idp1Key, &PushMessage{Timestamp: pushTimestamp(0)}, false},
+		{"identity provider not attached", "idp2", idp2Key, &PushMessage{Timestamp: pushTimestamp(0), Nonce: "n5"}, false},
+		{"unknown identity provider", "idp3", otherKey, &PushMessage{Timestamp: pushTimestamp(0), Nonce: "n6"}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := readPush(cryptoStorage, pushRequest(t, test.id, test.key, test.message))
+
+			if test.valid == true && err != nil {
+				t.Fatal(err)
+			}
+
+			if test.valid == false && err == nil {
+				t.Fatal("push message accepted")
+			}
+		})
+	}
+}
+
+func TestReadPushMessageReplay(t *testing.T) {
+	cryptoStorage, idp1Key, _ := setupPush(t)
+
+	body := pushRequest(t, "idp1", idp1Key, &PushMessage{Timestamp: pushTimestamp(0), Nonce: "replayed"})
+
+	var wg sync.WaitGroup
+	var accepted int32
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			if readPush(cryptoStorage, body) == nil {
+				atomic.AddInt32(&accepted, 1)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if accepted != 1 {
+		t.Fatalf("push message accepted %d times", accepted)
+	}
+
+	if readPush(cryptoStorage, body) == nil {
+		t.Fatal("replayed push message accepted")
+	}
+}
@@ -0,0 +1,54 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package handlers
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// RedirectToHTTPS answers every request with a permanent redirect to the same
+// URL on the TLS listener.
+type RedirectToHTTPS struct {
+	TLSAddress string
+}
+
+func (rh *RedirectToHTTPS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	hostname := r.Host
+
+	splitHost, _, err := net.SplitHostPort(r.Host)
+
+	if err == nil {
+		hostname = splitHost
+	}
+
+	hostname = strings.Trim(hostname, "[]")
+	host := hostname
+
+	_, port, err := net.SplitHostPort(rh.TLSAddress)
+
+	if err == nil && port != "" && port != "443" {
+		host = net.JoinHostPort(hostname, port)
+	} else if strings.Contains(hostname, ":") {
+		host = "[" + hostname + "]"
+	}
+
+	target := "https://" + host + r.URL.RequestURI()
+
+	http.Redirect(w, r, target, http.StatusMovedPermanently)
+}
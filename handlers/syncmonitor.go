@@ -0,0 +1,138 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package handlers
+
+import (
+	"log"
+	"sort"
+	"time"
+
+	"github.com/netclave/proxy/config"
+)
+
+// SyncMonitor reports the state of the wallet and token syncs per identity
+// provider and applies the staleness policy: with sync.stalepolicy
+// "failclosed" tokens of an identity provider whose wallets or tokens were
+// not synced for sync.stalethreshold seconds are rejected, with "failopen"
+// they are still accepted and the identity provider is only reported as
+// stale.
+type SyncMonitor struct {
+	Wallets   *IdentityProviderSync
+	Tokens    *IdentityProviderSync
+	TokenSync *TokenSync
+
+	started time.Time
+}
+
+// IdentityProviderStatus is the sync state of a single identity provider.
+type IdentityProviderStatus struct {
+	IdentityProviderID string
+	Wallets            SyncState
+	Tokens             SyncState
+	ActiveTokens       int
+	Stale              bool
+}
+
+func NewSyncMonitor(wallets *IdentityProviderSync, tokens *IdentityProviderSync, tokenSync *TokenSync) *SyncMonitor {
+	return &SyncMonitor{
+		Wallets:   wallets,
+		Tokens:    tokens,
+		TokenSync: tokenSync,
+		started:   time.Now(),
+	}
+}
+
+// Status returns the state of every identity provider, sorted by ID.
+func (sm *SyncMonitor) Status() []*IdentityProviderStatus {
+	walletStates := sm.Wallets.States()
+	tokenStates := sm.Tokens.States()
+
+	identityProviderIDs := []string{}
+
+	for identityProviderID := range walletStates {
+		identityProviderIDs = append(identityProviderIDs, identityProviderID)
+	}
+
+	for identityProviderID := range tokenStates {
+		_, ok := walletStates[identityProviderID]
+
+		if ok == false {
+			identityProviderIDs = append(identityProviderIDs, identityProviderID)
+		}
+	}
+
+	sort.Strings(identityProviderIDs)
+
+	statuses := []*IdentityProviderStatus{}
+
+	for _, identityProviderID := range identityProviderIDs {
+		walletState := walletStates[identityProviderID]
+		tokenState := tokenStates[identityProviderID]
+
+		statuses = append(statuses, &IdentityProviderStatus{
+			IdentityProviderID: identityProviderID,
+			Wallets:            walletState,
+			Tokens:             tokenState,
+			ActiveTokens:       sm.TokenSync.Count(identityProviderID),
+			Stale:              sm.stale(walletState, tokenState),
+		})
+	}
+
+	return statuses
+}
+
+// Reject reports whether tokens of the identity provider must be refused
+// because its data is stale and the policy is to fail closed.
+func (sm *SyncMonitor) Reject(identityProviderID string) bool {
+	if config.SyncStalePolicy != config.STALE_FAIL_CLOSED || config.SyncStaleThreshold <= 0 {
+		return false
+	}
+
+	walletState := sm.Wallets.States()[identityProviderID]
+	tokenState := sm.Tokens.States()[identityProviderID]
+
+	if sm.stale(walletState, tokenState) == false {
+		return false
+	}
+
+	log.Println("Data of identity provider " + identityProviderID + " is stale, rejecting its tokens")
+
+	return true
+}
+
+// stale reports whether the wallets or tokens were last synced longer than
+// the threshold ago. An identity provider not synced yet counts from the
+// start of the proxy.
+func (sm *SyncMonitor) stale(walletState SyncState, tokenState SyncState) bool {
+	if config.SyncStaleThreshold <= 0 {
+		return false
+	}
+
+	threshold := time.Duration(config.SyncStaleThreshold) * time.Second
+
+	for _, lastSuccess := range []time.Time{walletState.LastSuccess, tokenState.LastSuccess} {
+		if lastSuccess.Before(sm.started) {
+			lastSuccess = sm.started
+		}
+
+		if time.Since(lastSuccess) > threshold {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,159 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package handlers
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/netclave/common/cryptoutils"
+	"github.com/netclave/proxy/config"
+)
+
+func setStalePolicy(t *testing.T, policy string, threshold int64) {
+	policyBefore := config.SyncStalePolicy
+	thresholdBefore := config.SyncStaleThreshold
+
+	t.Cleanup(func() {
+		config.SyncStalePolicy = policyBefore
+		config.SyncStaleThreshold = thresholdBefore
+	})
+
+	config.SyncStalePolicy = policy
+	config.SyncStaleThreshold = threshold
+}
+
+// newTestSyncMonitor returns a monitor started at the given time for the
+// identity provider idp1, whose syncs are recorded with the returned function.
+func newTestSyncMonitor(started time.Time) (*SyncMonitor, func(started time.Time, err error)) {
+	noSync := func(identityProvider *cryptoutils.Identificator) (int, error) {
+		return 0, nil
+	}
+
+	interval := func() time.Duration {
+		return time.Second
+	}
+
+	wallets := NewIdentityProviderSync("wallets", noSync, interval, time.Minute)
+	tokens := NewIdentityProviderSync("tokens", noSync, interval, time.Minute)
+
+	for _, ips := range []*IdentityProviderSync{wallets, tokens} {
+		ips.states["idp1"] = &SyncState{}
+	}
+
+	syncMonitor := NewSyncMonitor(wallets, tokens, NewTokenSync())
+	syncMonitor.started = started
+
+	random := rand.New(rand.NewSource(1))
+
+	return syncMonitor, func(started time.Time, err error) {
+		wallets.record("idp1", started, 1, err, random)
+		tokens.record("idp1", started, 1, err, random)
+	}
+}
+
+func TestSyncMonitorFailClosed(t *testing.T) {
+	setStalePolicy(t, config.STALE_FAIL_CLOSED, 60)
+
+	// not synced yet, but the proxy only just started
+	syncMonitor, record := newTestSyncMonitor(time.Now())
+
+	if syncMonitor.Reject("idp1") == true {
+		t.Fatal("rejected before the threshold passed since the start")
+	}
+
+	syncMonitor, record = newTestSyncMonitor(time.Now().Add(-2 * time.Minute))
+
+	if syncMonitor.Reject("idp1") == false {
+		t.Fatal("never synced identity provider not rejected")
+	}
+
+	record(time.Now().Add(-90*time.Second), nil)
+
+	if syncMonitor.Reject("idp1") == false {
+		t.Fatal("stale identity provider not rejected")
+	}
+
+	if syncMonitor.Status()[0].Stale == false {
+		t.Fatal("stale identity provider not reported as stale")
+	}
+
+	// failures after a recent success do not make it stale
+	record(time.Now().Add(-30*time.Second), nil)
+	record(time.Now(), errors.New("unreachable"))
+
+	if syncMonitor.Reject("idp1") == true {
+		t.Fatal("identity provider synced within the threshold rejected")
+	}
+
+	if syncMonitor.Status()[0].Stale == true {
+		t.Fatal("identity provider synced within the threshold reported as stale")
+	}
+}
+
+func TestSyncMonitorSuccessClearsStale(t *testing.T) {
+	setStalePolicy(t, config.STALE_FAIL_CLOSED, 60)
+
+	syncMonitor, record := newTestSyncMonitor(time.Now().Add(-time.Hour))
+
+	record(time.Now().Add(-10*time.Minute), nil)
+	record(time.Now().Add(-time.Minute), errors.New("unreachable"))
+
+	if syncMonitor.Reject("idp1") == false {
+		t.Fatal("stale identity provider not rejected")
+	}
+
+	record(time.Now(), nil)
+
+	if syncMonitor.Reject("idp1") == true {
+		t.Fatal("rejected after a successful sync")
+	}
+
+	status := syncMonitor.Status()[0]
+
+	if status.Stale == true || status.Tokens.ConsecutiveErrors != 0 || status.Tokens.Backoff != 0 {
+		t.Fatalf("state not cleared by a successful sync: %+v", status)
+	}
+}
+
+func TestSyncMonitorFailOpen(t *testing.T) {
+	setStalePolicy(t, config.STALE_FAIL_OPEN, 60)
+
+	syncMonitor, record := newTestSyncMonitor(time.Now().Add(-time.Hour))
+
+	record(time.Now().Add(-10*time.Minute), nil)
+
+	if syncMonitor.Reject("idp1") == true {
+		t.Fatal("fail open rejected a stale identity provider")
+	}
+
+	if syncMonitor.Status()[0].Stale == false {
+		t.Fatal("stale identity provider not reported as stale")
+	}
+}
+
+func TestSyncMonitorNoThreshold(t *testing.T) {
+	setStalePolicy(t, config.STALE_FAIL_CLOSED, 0)
+
+	syncMonitor, _ := newTestSyncMonitor(time.Now().Add(-time.Hour))
+
+	if syncMonitor.Reject("idp1") == true || syncMonitor.Status()[0].Stale == true {
+		t.Fatal("stale without a threshold")
+	}
+}
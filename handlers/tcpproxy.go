@@ -0,0 +1,291 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/netclave/common/storage"
+	"github.com/netclave/proxy/component"
+	"github.com/netclave/proxy/config"
+)
+
+// IPSession records that a client address presented a valid NetClave token
+// over HTTP. TCP connections from the address are accepted while the session
+// lasts and its token still grants access to the TCP proxy's service.
+type IPSession struct {
+	IdentityProviderID string
+	WalletID           string
+	Token              string
+}
+
+type ipSessionWrite struct {
+	token   string
+	written time.Time
+}
+
+var ipSessionWrites = map[string]*ipSessionWrite{}
+var ipSessionWritesPruned time.Time
+var ipSessionWritesMutex sync.Mutex
+
+// storeIPSession records the session of the address. Every authenticated HTTP
+// request calls it, so the session is only written when it is new, its token
+// changed or it was written IPSessionTTL/2 or more ago.
+func storeIPSession(dataStorage *storage.GenericStorage, ip string, netClaveToken *NetClaveToken) error {
+	key := ip + "/" + netClaveToken.IdentityProviderID + "/" + netClaveToken.WalletID
+	ttl := time.Duration(config.IPSessionTTL) * time.Second
+	now := time.Now()
+
+	ipSessionWritesMutex.Lock()
+	defer ipSessionWritesMutex.Unlock()
+
+	last, ok := ipSessionWrites[key]
+
+	if ok == true && last.token == netClaveToken.Token && now.Sub(last.written) < ttl/2 {
+		return nil
+	}
+
+	session := &IPSession{
+		IdentityProviderID: netClaveToken.IdentityProviderID,
+		WalletID:           netClaveToken.WalletID,
+		Token:              netClaveToken.Token,
+	}
+
+	sessionJSON, err := json.Marshal(session)
+
+	if err != nil {
+		return err
+	}
+
+	err = dataStorage.SetKey(component.IP_SESSIONS, key, string(sessionJSON), ttl)
+
+	if err != nil {
+		return err
+	}
+
+	if now.Sub(ipSessionWritesPruned) >= ttl {
+		for otherKey, other := range ipSessionWrites {
+			if now.Sub(other.written) >= ttl {
+				delete(ipSessionWrites, otherKey)
+			}
+		}
+
+		ipSessionWritesPruned = now
+	}
+
+	ipSessionWrites[key] = &ipSessionWrite{
+		token:   netClaveToken.Token,
+		written: now,
+	}
+
+	return nil
+}
+
+// authorizeIPSession reports whether any wallet with a session for the
+// address is allowed to use the service. Sessions of identity providers the
+// sync monitor rejects as stale are skipped.
+func authorizeIPSession(dataStorage *storage.GenericStorage, syncMonitor *SyncMonitor, ip string, service string) (bool, error) {
+	keys, err := dataStorage.GetKeys(component.IP_SESSIONS, ip+"/*")
+
+	if err != nil {
+		return false, err
+	}
+
+	for _, key := range keys {
+		sessionJSON, err := dataStorage.GetKey(component.IP_SESSIONS, strings.TrimPrefix(key, component.IP_SESSIONS+"/"))
+
+		if err != nil {
+			return false, err
+		}
+
+		if sessionJSON == "" {
+			continue
+		}
+
+		session := &IPSession{}
+
+		err = json.Unmarshal([]byte(sessionJSON), session)
+
+		if err != nil {
+			log.Println(err.Error())
+			continue
+		}
+
+		if syncMonitor != nil && syncMonitor.Reject(session.IdentityProviderID) == true {
+			continue
+		}
+
+		authorized, err := authorizeWallet(dataStorage, session.IdentityProviderID, session.WalletID, session.Token, service)
+
+		if err != nil {
+			return false, err
+		}
+
+		if authorized == true {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// TCPProxy forwards raw TCP connections, such as SSH or database sessions,
+// from addresses holding an IP session. Like Handle it refuses sessions of
+// identity providers the SyncMonitor rejects as stale. The session is looked
+// up for the address the connection comes from, while HTTP requests record it
+// for the client address behind trusted proxies. A TCP proxy must therefore be
+// reached by clients directly, not through a load balancer, whose address
+// never holds a session.
+type TCPProxy struct {
+	Rule        *config.TCPProxyRule
+	Dialer      *net.Dialer
+	SyncMonitor *SyncMonitor
+
+	mutex    sync.Mutex
+	listener net.Listener
+	closed   bool
+}
+
+// Serve accepts connections on the listener until Close is called.
+func (tp *TCPProxy) Serve(listener net.Listener) error {
+	tp.mutex.Lock()
+	tp.listener = listener
+	closed := tp.closed
+	tp.mutex.Unlock()
+
+	if closed == true {
+		listener.Close()
+		return nil
+	}
+
+	log.Println("Binding TCP to: " + tp.Rule.Listen)
+
+	for {
+		conn, err := listener.Accept()
+
+		if err != nil {
+			tp.mutex.Lock()
+			closed := tp.closed
+			tp.mutex.Unlock()
+
+			if closed == true {
+				return nil
+			}
+
+			netErr, ok := err.(net.Error)
+
+			if ok == true && netErr.Temporary() {
+				log.Println(err.Error())
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+
+			return err
+		}
+
+		go tp.serve(conn)
+	}
+}
+
+// Close stops accepting connections, connections already proxied are left
+// to DrainConnections.
+func (tp *TCPProxy) Close() error {
+	tp.mutex.Lock()
+	defer tp.mutex.Unlock()
+
+	tp.closed = true
+
+	if tp.listener == nil {
+		return nil
+	}
+
+	return tp.listener.Close()
+}
+
+func (tp *TCPProxy) serve(client net.Conn) {
+	defer client.Close()
+
+	ip, _, err := net.SplitHostPort(client.RemoteAddr().String())
+
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+
+	// IP sessions are keyed by the client address resolved from the
+	// forwarded headers, which a raw connection does not have
+	if isTrustedProxy(ip) == true {
+		log.Printf("TCP connection on %s from trusted proxy %s, TCP proxies must be reached by clients directly", tp.Rule.Listen, ip)
+	}
+
+	dataStorage := component.CreateDataStorage()
+	fail2banDataStorage := component.CreateFail2BanDataStorage()
+
+	banned, err := IsBanned(fail2banDataStorage, ip)
+
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+
+	if banned == true {
+		log.Printf("Banned address: %s", ip)
+		return
+	}
+
+	authorized, err := authorizeIPSession(dataStorage, tp.SyncMonitor, ip, tp.Rule.Service)
+
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+
+	if authorized == false {
+		log.Printf("No IP session for %s on %s", ip, tp.Rule.Listen)
+
+		event, err := createEvent(ip)
+
+		if err != nil {
+			log.Println(err.Error())
+			return
+		}
+
+		err = RegisterFailure(fail2banDataStorage, event)
+
+		if err != nil {
+			log.Println(err.Error())
+		}
+
+		return
+	}
+
+	upstream, err := tp.Dialer.Dial("tcp", tp.Rule.Upstream)
+
+	if err != nil {
+		log.Printf("TCP Dial %s: %v", tp.Rule.Upstream, err)
+		return
+	}
+	defer upstream.Close()
+
+	pipeConnections(client, client, upstream, upstream,
+		time.Duration(tp.Rule.IdleTimeout)*time.Second, time.Duration(tp.Rule.MaxLifetime)*time.Second)
+}
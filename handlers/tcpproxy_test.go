@@ -0,0 +1,104 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/netclave/proxy/component"
+	"github.com/netclave/proxy/config"
+)
+
+func TestStoreIPSessionThrottled(t *testing.T) {
+	dataStorage := newTestStorage(t)
+
+	defer func(previous int64) {
+		config.IPSessionTTL = previous
+	}(config.IPSessionTTL)
+
+	config.IPSessionTTL = 300
+
+	token := &NetClaveToken{
+		IdentityProviderID: "idp",
+		WalletID:           "wallet",
+		Token:              "token1",
+	}
+
+	key := "10.0.0.1/idp/wallet"
+
+	stored := func() bool {
+		value, err := dataStorage.GetKey(component.IP_SESSIONS, key)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return value != ""
+	}
+
+	err := storeIPSession(dataStorage, "10.0.0.1", token)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stored() == false {
+		t.Fatal("new session not written")
+	}
+
+	// a session written recently is not written again
+	dataStorage.DelKey(component.IP_SESSIONS, key)
+
+	err = storeIPSession(dataStorage, "10.0.0.1", token)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stored() == true {
+		t.Fatal("recent session written again")
+	}
+
+	token.Token = "token2"
+
+	err = storeIPSession(dataStorage, "10.0.0.1", token)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stored() == false {
+		t.Fatal("session with a new token not written")
+	}
+
+	dataStorage.DelKey(component.IP_SESSIONS, key)
+
+	ipSessionWritesMutex.Lock()
+	ipSessionWrites[key].written = time.Now().Add(-time.Duration(config.IPSessionTTL/2) * time.Second)
+	ipSessionWritesMutex.Unlock()
+
+	err = storeIPSession(dataStorage, "10.0.0.1", token)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stored() == false {
+		t.Fatal("session close to expiry not renewed")
+	}
+}
@@ -0,0 +1,335 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/netclave/common/cryptoutils"
+	"github.com/netclave/common/httputils"
+	"github.com/netclave/common/jsonutils"
+	"github.com/netclave/common/storage"
+	"github.com/netclave/proxy/component"
+	"github.com/netclave/proxy/config"
+)
+
+// TokenChanges is the answer of an identity provider to /getActiveTokens.
+// When Full is set Tokens is the complete set of active tokens per wallet,
+// otherwise Tokens holds the tokens issued and Removed the tokens revoked
+// since the revision the proxy asked for. Revision is passed back on the next
+// request. Identity providers without revisions answer with the plain map of
+// active tokens, which is read as a full set.
+type TokenChanges struct {
+	Revision string              `json:"revision"`
+	Full     bool                `json:"full"`
+	Tokens   map[string][]string `json:"tokens"`
+	Removed  map[string][]string `json:"removed"`
+}
+
+// fetchActiveTokens asks the identity provider for the changes since the
+// revision, or for all active tokens when the revision is empty.
+func fetchActiveTokens(cryptoStorage *cryptoutils.CryptoStorage, identityProvider *cryptoutils.Identificator, revision string) (*TokenChanges, error) {
+	publicKey, err := cryptoStorage.RetrievePublicKey(identityProvider.IdentificatorID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	openersURL := identityProvider.IdentificatorURL + "/getActiveTokens"
+
+	openerID := component.ComponentIdentificatorID
+	privateKeyPEM := component.ComponentPrivateKey
+	publicKeyPEM := component.ComponentPublicKey
+
+	var data interface{} = ""
+
+	if revision != "" {
+		data = map[string]string{
+			"revision": revision,
+		}
+	}
+
+	request, err := jsonutils.SignAndEncryptResponse(data, openerID,
+		privateKeyPEM, publicKeyPEM, publicKey, false)
+
+	if err != nil {
+		return nil, err
+	}
+
+	response, _, _, err := httputils.MakePostRequest(openersURL, request, true, component.ComponentPrivateKey, cryptoStorage)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return parseTokenChanges(response)
+}
+
+func parseTokenChanges(response string) (*TokenChanges, error) {
+	var fields map[string]json.RawMessage
+
+	err := json.Unmarshal([]byte(response), &fields)
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, ok := fields["revision"]
+
+	if ok == false {
+		var activeTokens map[string][]string
+
+		err = json.Unmarshal([]byte(response), &activeTokens)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &TokenChanges{
+			Full:   true,
+			Tokens: activeTokens,
+		}, nil
+	}
+
+	changes := &TokenChanges{}
+
+	err = json.Unmarshal([]byte(response), changes)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return changes, nil
+}
+
+// TokenSync mirrors the active tokens of the identity providers into the
+// tokens table. It remembers the tokens and revision of every identity
+// provider, so later syncs only transfer changes, and deletes tokens from
+// the table as soon as their identity provider no longer lists them. Tokens
+// are stored with config.TokenTTL, which is renewed while they stay active.
+type TokenSync struct {
+	mutex      sync.Mutex
+	storeMutex sync.Mutex
+	revisions  map[string]string
+	tokens     map[string]map[string]bool
+	synced     map[string]bool
+	revoked    map[string]bool
+	written    map[string]time.Time
+	listed     bool
+}
+
+func NewTokenSync() *TokenSync {
+	return &TokenSync{
+		revisions: map[string]string{},
+		tokens:    map[string]map[string]bool{},
+		synced:    map[string]bool{},
+		revoked:   map[string]bool{},
+		written:   map[string]time.Time{},
+	}
+}
+
+// Apply merges changes reported by an identity provider. Changes without a
+// revision, as pushed by identity providers, leave the revision unchanged.
+func (ts *TokenSync) Apply(identityProviderID string, changes *TokenChanges) {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	tokens, ok := ts.tokens[identityProviderID]
+
+	if ok == false || changes.Full == true {
+		tokens = map[string]bool{}
+		ts.tokens[identityProviderID] = tokens
+	}
+
+	if changes.Full == true {
+		ts.synced[identityProviderID] = true
+	}
+
+	for walletID, walletTokens := range changes.Tokens {
+		for _, token := range walletTokens {
+			tokens[walletID+"/"+token] = true
+			delete(ts.revoked, identityProviderID+"/"+walletID+"/"+token)
+		}
+	}
+
+	for walletID, walletTokens := range changes.Removed {
+		for _, token := range walletTokens {
+			delete(tokens, walletID+"/"+token)
+			ts.revoked[identityProviderID+"/"+walletID+"/"+token] = true
+		}
+	}
+
+	if changes.Full == true || changes.Revision != "" {
+		ts.revisions[identityProviderID] = changes.Revision
+	}
+}
+
+// SyncIdentityProvider fetches the changes of a single identity provider and
+// stores the result. It returns the number of active tokens of the identity
+// provider.
+func (ts *TokenSync) SyncIdentityProvider(identityProvider *cryptoutils.Identificator) (int, error) {
+	cryptoStorage := component.CreateCryptoStorage()
+
+	ts.mutex.Lock()
+	revision := ts.revisions[identityProvider.IdentificatorID]
+	ts.mutex.Unlock()
+
+	changes, err := fetchActiveTokens(cryptoStorage, identityProvider, revision)
+
+	if err != nil {
+		return 0, err
+	}
+
+	ts.Apply(identityProvider.IdentificatorID, changes)
+
+	identityProviders, err := cryptoStorage.GetIdentificatorToIdentificatorMap(component.ProxyIdentificator, cryptoutils.IDENTIFICATOR_TYPE_IDENTITY_PROVIDER)
+
+	if err != nil {
+		return 0, err
+	}
+
+	err = ts.Store(component.CreateDataStorage(), identityProviders)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return ts.Count(identityProvider.IdentificatorID), nil
+}
+
+// Count returns the number of active tokens of the identity provider.
+func (ts *TokenSync) Count(identityProviderID string) int {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	return len(ts.tokens[identityProviderID])
+}
+
+// Store writes the tokens of all identity providers to the tokens table,
+// keyed by identity provider, wallet and token, and deletes the ones no
+// longer active. Revoked tokens are deleted right away, other tokens missing
+// from an identity provider only once it has sent its full set, so a restart
+// does not drop valid tokens. Tokens of identity providers no longer attached
+// to the proxy are deleted as well. The table is listed only on the first
+// Store, afterwards the keys written before are kept in memory and only the
+// difference to the active tokens is written and deleted.
+func (ts *TokenSync) Store(dataStorage *storage.GenericStorage, identityProviders map[string]*cryptoutils.Identificator) error {
+	ts.storeMutex.Lock()
+	defer ts.storeMutex.Unlock()
+
+	ts.mutex.Lock()
+
+	active := map[string]bool{}
+	complete := map[string]bool{}
+
+	for identityProviderID := range identityProviders {
+		complete[identityProviderID] = ts.synced[identityProviderID]
+
+		for key := range ts.tokens[identityProviderID] {
+			active[identityProviderID+"/"+key] = true
+		}
+	}
+
+	revoked := ts.revoked
+	ts.revoked = map[string]bool{}
+
+	ts.mutex.Unlock()
+
+	if ts.listed == false {
+		keys, err := dataStorage.GetKeys(component.TOKENS, "*")
+
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			key = strings.TrimPrefix(key, component.TOKENS+"/")
+
+			_, ok := ts.written[key]
+
+			if ok == false {
+				ts.written[key] = time.Time{}
+			}
+		}
+
+		ts.listed = true
+	}
+
+	for key := range revoked {
+		_, ok := ts.written[key]
+
+		if ok == false && active[key] == false {
+			ts.written[key] = time.Time{}
+		}
+	}
+
+	for key := range ts.written {
+		if active[key] == true {
+			continue
+		}
+
+		parts := strings.SplitN(key, "/", 3)
+
+		if len(parts) == 3 {
+			_, attached := identityProviders[parts[0]]
+
+			if attached == true && complete[parts[0]] == false && revoked[key] == false {
+				continue
+			}
+		}
+
+		_, err := dataStorage.DelKey(component.TOKENS, key)
+
+		if err != nil {
+			return err
+		}
+
+		delete(ts.written, key)
+
+		if len(parts) == 3 {
+			log.Println("Token revoked for wallet " + parts[1] + " of identity provider " + parts[0])
+		}
+	}
+
+	// tokens are written again once half of their TTL passed, so they do
+	// not expire while their identity provider still lists them
+	refresh := config.TokenTTL * time.Second / 2
+
+	for key := range active {
+		writtenAt, ok := ts.written[key]
+
+		if ok == true && time.Since(writtenAt) < refresh {
+			continue
+		}
+
+		token := key[strings.LastIndex(key, "/")+1:]
+
+		err := dataStorage.SetKey(component.TOKENS, key, token, config.TokenTTL*time.Second)
+
+		if err != nil {
+			return err
+		}
+
+		ts.written[key] = time.Now()
+	}
+
+	return nil
+}
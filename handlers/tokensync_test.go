@@ -0,0 +1,367 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package handlers
+
+import (
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/netclave/common/cryptoutils"
+	"github.com/netclave/common/storage"
+	"github.com/netclave/proxy/component"
+	"github.com/netclave/proxy/config"
+)
+
+// newTestStorage points the data storage at a fresh sqlite database.
+func newTestStorage(t *testing.T) *storage.GenericStorage {
+	t.Helper()
+
+	config.StorageType = storage.SQLITE_STORAGE
+	config.DataStorageCredentials = map[string]string{
+		"filename": filepath.Join(t.TempDir(), "data.db"),
+	}
+
+	err := component.InitDataStorage()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return component.CreateDataStorage()
+}
+
+func storedTokens(t *testing.T, dataStorage *storage.GenericStorage) []string {
+	t.Helper()
+
+	keys, err := dataStorage.GetKeys(component.TOKENS, "*")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokens := []string{}
+
+	for _, key := range keys {
+		tokens = append(tokens, strings.TrimPrefix(key, component.TOKENS+"/"))
+	}
+
+	sort.Strings(tokens)
+
+	return tokens
+}
+
+func identityProviders(ids ...string) map[string]*cryptoutils.Identificator {
+	identityProviders := map[string]*cryptoutils.Identificator{}
+
+	for _, id := range ids {
+		identityProviders[id] = &cryptoutils.Identificator{
+			IdentificatorID:   id,
+			IdentificatorType: cryptoutils.IDENTIFICATOR_TYPE_IDENTITY_PROVIDER,
+		}
+	}
+
+	return identityProviders
+}
+
+func assertTokens(t *testing.T, dataStorage *storage.GenericStorage, expected ...string) {
+	t.Helper()
+
+	tokens := storedTokens(t, dataStorage)
+
+	if reflect.DeepEqual(tokens, expected) == false {
+		t.Fatalf("stored tokens %v, expected %v", tokens, expected)
+	}
+}
+
+func TestParseTokenChanges(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		expected *TokenChanges
+	}{
+		{
+			name:     "legacy map is a full set",
+			response: `{"w1": ["t1", "t2"]}`,
+			expected: &TokenChanges{Full: true, Tokens: map[string][]string{"w1": {"t1", "t2"}}},
+		},
+		{
+			name:     "diff",
+			response: `{"revision": "5", "tokens": {"w1": ["t3"]}, "removed": {"w1": ["t1"]}}`,
+			expected: &TokenChanges{
+				Revision: "5",
+				Tokens:   map[string][]string{"w1": {"t3"}},
+				Removed:  map[string][]string{"w1": {"t1"}},
+			},
+		},
+		{
+			name:     "full set with revision",
+			response: `{"revision": "6", "full": true, "tokens": {"w2": ["t4"]}}`,
+			expected: &TokenChanges{Revision: "6", Full: true, Tokens: map[string][]string{"w2": {"t4"}}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			changes, err := parseTokenChanges(test.response)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if reflect.DeepEqual(changes, test.expected) == false {
+				t.Fatalf("got %+v, expected %+v", changes, test.expected)
+			}
+		})
+	}
+
+	_, err := parseTokenChanges(`["t1"]`)
+
+	if err == nil {
+		t.Fatal("expected an error for a list")
+	}
+}
+
+func TestTokenSyncDiffAndRevision(t *testing.T) {
+	dataStorage := newTestStorage(t)
+	tokenSync := NewTokenSync()
+	idps := identityProviders("idp1")
+
+	tokenSync.Apply("idp1", &TokenChanges{
+		Revision: "1",
+		Full:     true,
+		Tokens:   map[string][]string{"w1": {"t1", "t2"}},
+	})
+
+	err := tokenSync.Store(dataStorage, idps)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertTokens(t, dataStorage, "idp1/w1/t1", "idp1/w1/t2")
+
+	tokenSync.Apply("idp1", &TokenChanges{
+		Revision: "2",
+		Tokens:   map[string][]string{"w2": {"t3"}},
+		Removed:  map[string][]string{"w1": {"t1"}},
+	})
+
+	err = tokenSync.Store(dataStorage, idps)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertTokens(t, dataStorage, "idp1/w1/t2", "idp1/w2/t3")
+
+	if tokenSync.revisions["idp1"] != "2" {
+		t.Fatalf("revision %q, expected 2", tokenSync.revisions["idp1"])
+	}
+
+	// pushed changes carry no revision and must not reset it
+	tokenSync.Apply("idp1", &TokenChanges{
+		Tokens: map[string][]string{"w2": {"t4"}},
+	})
+
+	if tokenSync.revisions["idp1"] != "2" {
+		t.Fatalf("revision %q after push, expected 2", tokenSync.revisions["idp1"])
+	}
+
+	if tokenSync.Count("idp1") != 3 {
+		t.Fatalf("%d active tokens, expected 3", tokenSync.Count("idp1"))
+	}
+
+	// a full set replaces everything
+	tokenSync.Apply("idp1", &TokenChanges{
+		Revision: "3",
+		Full:     true,
+		Tokens:   map[string][]string{"w2": {"t4"}},
+	})
+
+	err = tokenSync.Store(dataStorage, idps)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertTokens(t, dataStorage, "idp1/w2/t4")
+}
+
+func TestTokenSyncRevocation(t *testing.T) {
+	dataStorage := newTestStorage(t)
+
+	// left over from before the tokens were keyed by identity provider
+	err := dataStorage.SetKey(component.TOKENS, "w1/legacy", "legacy", 0)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// stored before a restart, not known to the new TokenSync
+	err = dataStorage.SetKey(component.TOKENS, "idp1/w1/old", "old", 0)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = dataStorage.SetKey(component.TOKENS, "idp1/w1/kept", "kept", 0)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = dataStorage.SetKey(component.TOKENS, "gone/w1/t1", "t1", 0)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokenSync := NewTokenSync()
+	idps := identityProviders("idp1", "idp2")
+
+	// idp1 only sent a diff so far, its unknown tokens must stay
+	tokenSync.Apply("idp1", &TokenChanges{
+		Revision: "7",
+		Tokens:   map[string][]string{"w1": {"t1"}},
+		Removed:  map[string][]string{"w1": {"old"}},
+	})
+
+	err = tokenSync.Store(dataStorage, idps)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertTokens(t, dataStorage, "idp1/w1/kept", "idp1/w1/t1")
+
+	// revoking a token of one identity provider leaves the other's alone
+	tokenSync.Apply("idp2", &TokenChanges{
+		Full:   true,
+		Tokens: map[string][]string{"w1": {"t1"}},
+	})
+	tokenSync.Apply("idp1", &TokenChanges{
+		Revision: "8",
+		Removed:  map[string][]string{"w1": {"t1"}},
+	})
+
+	err = tokenSync.Store(dataStorage, idps)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertTokens(t, dataStorage, "idp1/w1/kept", "idp2/w1/t1")
+
+	// once idp1 sent its full set tokens it does not list are deleted
+	tokenSync.Apply("idp1", &TokenChanges{
+		Revision: "9",
+		Full:     true,
+		Tokens:   map[string][]string{},
+	})
+
+	err = tokenSync.Store(dataStorage, idps)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertTokens(t, dataStorage, "idp2/w1/t1")
+}
+
+func TestTokenSyncRenewsTTL(t *testing.T) {
+	dataStorage := newTestStorage(t)
+	tokenSync := NewTokenSync()
+	idps := identityProviders("idp1")
+
+	tokenSync.Apply("idp1", &TokenChanges{
+		Full:   true,
+		Tokens: map[string][]string{"w1": {"t1"}},
+	})
+
+	err := tokenSync.Store(dataStorage, idps)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	firstWrite := tokenSync.written["idp1/w1/t1"]
+
+	err = tokenSync.Store(dataStorage, idps)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tokenSync.written["idp1/w1/t1"].Equal(firstWrite) == false {
+		t.Fatal("token written again before half of its TTL passed")
+	}
+
+	tokenSync.written["idp1/w1/t1"] = time.Now().Add(-config.TokenTTL * time.Second)
+
+	err = tokenSync.Store(dataStorage, idps)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if time.Since(tokenSync.written["idp1/w1/t1"]) > time.Minute {
+		t.Fatal("token TTL not renewed")
+	}
+
+	assertTokens(t, dataStorage, "idp1/w1/t1")
+}
+
+func TestTokenSyncListsOnce(t *testing.T) {
+	dataStorage := newTestStorage(t)
+	tokenSync := NewTokenSync()
+	idps := identityProviders("idp1")
+
+	tokenSync.Apply("idp1", &TokenChanges{
+		Full:   true,
+		Tokens: map[string][]string{"w1": {"t1", "t2"}},
+	})
+
+	err := tokenSync.Store(dataStorage, idps)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// written behind the back of the TokenSync after it listed the table
+	err = dataStorage.SetKey(component.TOKENS, "idp1/w1/unlisted", "unlisted", 0)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokenSync.Apply("idp1", &TokenChanges{
+		Full:   true,
+		Tokens: map[string][]string{"w1": {"t2"}},
+	})
+
+	err = tokenSync.Store(dataStorage, idps)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertTokens(t, dataStorage, "idp1/w1/t2", "idp1/w1/unlisted")
+}
@@ -0,0 +1,93 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/netclave/common/storage"
+	"github.com/netclave/proxy/component"
+	"github.com/netclave/proxy/config"
+)
+
+// StoreWalletsAndServices stores the public keys of the wallets of an identity
+// provider and the services they may access. Both are kept per identity
+// provider, so a wallet ID reported by another identity provider can not
+// change them. Wallets are deliberately not added to the crypto storage,
+// whose identificators and keys are shared with the identity providers. A
+// wallet that can not be stored is logged and skipped, the first error is
+// returned after all wallets were tried.
+func StoreWalletsAndServices(dataStorage *storage.GenericStorage, identityProviderID string, walletsAndServices *WalletsAndServices) error {
+	var firstErr error
+
+	for key, value := range walletsAndServices.PublicKeys {
+		err := storeWallet(dataStorage, identityProviderID, key, value, walletsAndServices.Services[key])
+
+		if err != nil {
+			log.Println(err.Error())
+
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	return firstErr
+}
+
+func storeWallet(dataStorage *storage.GenericStorage, identityProviderID string, walletID string, publicKey string, services []string) error {
+	err := dataStorage.SetKey(component.WALLET_KEYS, identityProviderID+"/"+walletID, publicKey, config.TokenTTL*time.Second)
+
+	if err != nil {
+		return err
+	}
+
+	if services == nil {
+		return nil
+	}
+
+	jsonData, err := json.Marshal(services)
+
+	if err != nil {
+		return err
+	}
+
+	return dataStorage.SetKey(component.SERVICES, identityProviderID+"/"+walletID, string(jsonData), config.TokenTTL*time.Second)
+}
+
+// RemoveWallets withdraws the keys and services the identity provider
+// reported for the wallets, so none of their tokens from it is accepted any
+// more.
+func RemoveWallets(dataStorage *storage.GenericStorage, identityProviderID string, walletIDs []string) error {
+	for _, walletID := range walletIDs {
+		_, err := dataStorage.DelKey(component.SERVICES, identityProviderID+"/"+walletID)
+
+		if err != nil {
+			return err
+		}
+
+		_, err = dataStorage.DelKey(component.WALLET_KEYS, identityProviderID+"/"+walletID)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
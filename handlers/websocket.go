@@ -0,0 +1,174 @@
+/*
+ * Copyright @ 2020 - present Blackvisor Ltd.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package handlers
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/netclave/proxy/balancer"
+	"github.com/netclave/proxy/config"
+)
+
+// isWebSocketUpgrade reports whether the request asks to switch to the
+// websocket protocol. Connection and Upgrade are token lists compared without
+// regard to case.
+func isWebSocketUpgrade(r *http.Request) bool {
+	return headerHasToken(r.Header, "Connection", "upgrade") && headerHasToken(r.Header, "Upgrade", "websocket")
+}
+
+func headerHasToken(header http.Header, name string, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// dialAddress returns the host:port to dial for an upstream URL and whether
+// the connection uses TLS.
+func dialAddress(target *url.URL) (string, bool) {
+	secure := target.Scheme == "https" || target.Scheme == "wss"
+	port := target.Port()
+
+	if port == "" {
+		port = "80"
+
+		if secure == true {
+			port = "443"
+		}
+	}
+
+	return net.JoinHostPort(target.Hostname(), port), secure
+}
+
+// proxyWebSocket sends the upgrade request to the backend and, once the
+// backend switched protocols, copies frames both ways until either side
+// closes or the connection runs into the configured idle timeout or maximum
+// lifetime. A backend refusing the upgrade is answered to the client as is.
+func proxyWebSocket(w http.ResponseWriter, r *http.Request, pathRoute *config.PathRoute, backend *balancer.Backend) {
+	hj, ok := w.(http.Hijacker)
+
+	if ok == false {
+		log.Printf("websocket: connection can not be hijacked")
+		writeError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	address, secure := dialAddress(backend.URL)
+
+	var be net.Conn
+	var err error
+
+	if secure == true {
+		be, err = tls.DialWithDialer(pathRoute.Dialer, "tcp", address, pathRoute.TLSConfig)
+	} else {
+		be, err = pathRoute.Dialer.Dial("tcp", address)
+	}
+
+	if err != nil {
+		log.Printf("websocket Dial %s: %v", address, err)
+
+		pathRoute.Pool.MarkFailed(backend, err)
+		writeError(w, r, upstreamErrorCode(err))
+		return
+	}
+	defer be.Close()
+
+	appendForwardedFor(r)
+	directRequest(r, backend.URL)
+
+	if config.TransportResponseHeaderTimeout > 0 {
+		be.SetDeadline(time.Now().Add(time.Duration(config.TransportResponseHeaderTimeout) * time.Second))
+	}
+
+	err = r.Write(be)
+
+	if err != nil {
+		log.Printf("websocket backend write request: %v", err)
+
+		pathRoute.Pool.MarkFailed(backend, err)
+		writeError(w, r, upstreamErrorCode(err))
+		return
+	}
+
+	beReader := bufio.NewReader(be)
+
+	resp, err := http.ReadResponse(beReader, r)
+
+	if err != nil {
+		log.Printf("websocket backend read response: %v", err)
+
+		pathRoute.Pool.MarkFailed(backend, err)
+		writeError(w, r, upstreamErrorCode(err))
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		for key, values := range resp.Header {
+			for _, value := range values {
+				w.Header().Add(key, value)
+			}
+		}
+
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		return
+	}
+
+	if headerHasToken(resp.Header, "Upgrade", "websocket") == false {
+		log.Printf("websocket: backend switched to %q", resp.Header.Get("Upgrade"))
+		writeError(w, r, http.StatusBadGateway)
+		return
+	}
+
+	be.SetDeadline(time.Time{})
+
+	c, brw, err := hj.Hijack()
+
+	if err != nil {
+		log.Printf("websocket hijack: %v", err)
+		return
+	}
+	defer c.Close()
+
+	brw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	resp.Header.Write(brw)
+	brw.WriteString("\r\n")
+
+	err = brw.Flush()
+
+	if err != nil {
+		log.Printf("websocket client write response: %v", err)
+		return
+	}
+
+	pipeConnections(c, brw.Reader, be, beReader,
+		time.Duration(config.WebSocketIdleTimeout)*time.Second, time.Duration(config.WebSocketMaxLifetime)*time.Second)
+}
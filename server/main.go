@@ -17,39 +17,39 @@
 package main
 
 import (
-	"crypto/tls"
-	"encoding/json"
+	"context"
 	"fmt"
 	"log"
 	"math"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	api "github.com/netclave/apis/proxy/api"
-	"github.com/netclave/common/cryptoutils"
 	"github.com/netclave/common/utils"
+	"github.com/netclave/proxy/adminapi"
+	"github.com/netclave/proxy/certificates"
 	"github.com/netclave/proxy/component"
 	"github.com/netclave/proxy/config"
+	"github.com/netclave/proxy/graceful"
 	"github.com/netclave/proxy/handlers"
 
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/reflection"
 )
 
-func startGRPCServer(address string) error {
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
-
-	// create a listener on TCP port
-	lis, err := net.Listen("tcp", address)
-
-	if err != nil {
-		log.Println(err.Error())
-		return err
-	}
-
+func newGRPCServer(syncMonitor *handlers.SyncMonitor) *grpc.Server {
 	// create a server instance
-	s := handlers.GrpcServer{}
+	s := handlers.GrpcServer{
+		SyncMonitor: syncMonitor,
+	}
 
 	ServerMaxReceiveMessageSize := math.MaxInt32
 
@@ -59,10 +59,16 @@ func startGRPCServer(address string) error {
 
 	// attach the Ping service to the server
 	api.RegisterProxyAdminServer(grpcServer, &s)
+	adminapi.RegisterProxyAdminServer(grpcServer, &s)
 
-	// start the server
-	log.Printf("starting HTTP/2 gRPC server on %s", address)
 	reflection.Register(grpcServer)
+
+	return grpcServer
+}
+
+func startGRPCServer(grpcServer *grpc.Server, lis net.Listener) error {
+	// start the server
+	log.Printf("starting HTTP/2 gRPC server on %s", lis.Addr().String())
 	if err := grpcServer.Serve(lis); err != nil {
 		return fmt.Errorf("failed to serve: %s", err)
 	}
@@ -70,202 +76,455 @@ func startGRPCServer(address string) error {
 	return nil
 }
 
-func startWalletsAndServicesDaemon() error {
+// syncInterval is the polling interval of the sync daemons. With the push
+// endpoint enabled identity providers report changes themselves and polling
+// only reconciles. Either interval is below half of the token TTL, so every
+// sync of an identity provider renews its stored tokens in time.
+func syncInterval() time.Duration {
+	if config.ListenPushAddress != "" {
+		return time.Duration(config.SyncReconcileInterval) * time.Second
+	}
 
-	for {
-		walletsAndServices, err := handlers.GetWalletsAndServiceInternal()
+	return time.Duration(config.SyncInterval) * time.Second
+}
+
+func startPushServer(srv *http.Server, listener net.Listener) error {
+	log.Println("Binding push endpoint to: " + listener.Addr().String())
+
+	if err := srv.Serve(listener); err != nil && err != http.ErrServerClosed {
+		log.Println("Serve: " + err.Error())
+		return err
+	}
+
+	return nil
+}
+
+func startProxyServer(srv *http.Server, listener net.Listener) error {
+	log.Println("Binding to: " + listener.Addr().String())
+
+	if err := srv.Serve(listener); err != nil && err != http.ErrServerClosed {
+		log.Println("Serve: " + err.Error())
+		return err
+	}
+
+	return nil
+}
+
+func startProxyTLSServer(srv *http.Server, listener net.Listener) error {
+	err := http2.ConfigureServer(srv, &http2.Server{})
+
+	if err != nil {
+		log.Println(err.Error())
+		return err
+	}
+
+	log.Println("Binding TLS to: " + listener.Addr().String())
+
+	if err := srv.ServeTLS(listener, "", ""); err != nil && err != http.ErrServerClosed {
+		log.Println("ServeTLS: " + err.Error())
+		return err
+	}
+
+	return nil
+}
+
+func startCertificatesDaemon(ctx context.Context, store *certificates.Store) error {
+	for ctx.Err() == nil {
+		handlers.Sleep(ctx, time.Duration(config.CertificatesReloadInterval)*time.Second)
+
+		store.Reload()
+	}
+
+	return nil
+}
+
+func startFail2BanDeamon(ctx context.Context) error {
+	for ctx.Err() == nil {
+		fail2banDataStorage := component.CreateFail2BanDataStorage()
+
+		err := utils.LogBannedIPs(fail2banDataStorage)
 
 		if err != nil {
 			log.Println(err.Error())
-			time.Sleep(2 * time.Second)
+			return err
+		}
+
+		handlers.Sleep(ctx, 2*time.Second)
+	}
+
+	return nil
+}
+
+// routesReloader swaps in the rules of the configuration file on SIGHUP and
+// whenever the file changes. Rules that fail to load are logged and the
+// running ones are kept.
+type routesReloader struct {
+	mutex            sync.Mutex
+	ctx              context.Context
+	handle           *handlers.Handle
+	stopHealthChecks context.CancelFunc
+}
+
+func (rr *routesReloader) reload(reason string) {
+	rr.mutex.Lock()
+	defer rr.mutex.Unlock()
+
+	log.Println("Reloading rules, " + reason)
+
+	rules, routes, err := config.LoadRoutes()
+
+	if err != nil {
+		log.Println("Keeping current rules, reload failed: " + err.Error())
+		return
+	}
+
+	healthChecksCtx, stopHealthChecks := context.WithCancel(rr.ctx)
+	routes.StartHealthChecks(healthChecksCtx)
+
+	oldRoutes := rr.handle.Routes()
+
+	rr.handle.SetRoutes(routes)
+	config.UpdateRoutes(rules, routes)
+
+	rr.stopHealthChecks()
+	rr.stopHealthChecks = stopHealthChecks
+
+	oldRoutes.CloseIdleConnections()
+
+	log.Println("Rules reloaded")
+}
+
+func startReloadDaemon(ctx context.Context, reloader *routesReloader) error {
+	config.WatchConfigFile(func() {
+		reloader.reload("configuration file changed")
+	})
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case sig := <-signals:
+			reloader.reload("received " + sig.String())
+		}
+	}
+}
+
+// waitForShutdown blocks until the process is asked to stop. The upgrade
+// signal first hands the listeners to a new process, which takes over while
+// this one drains. A new process that does not report ready is killed and
+// this one keeps serving.
+func waitForShutdown() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, append([]os.Signal{os.Interrupt, syscall.SIGTERM}, graceful.UpgradeSignals...)...)
+
+	for sig := range signals {
+		if sig == os.Interrupt || sig == syscall.SIGTERM {
+			log.Println("Received " + sig.String())
+			return
+		}
+
+		log.Println("Received " + sig.String() + ", upgrading")
+
+		err := graceful.Upgrade(time.Duration(config.UpgradeTimeout) * time.Second)
+
+		if err != nil {
+			log.Println("Upgrade failed, still serving: " + err.Error())
 			continue
 		}
 
-		cryptoStorage := component.CreateCryptoStorage()
+		return
+	}
+}
 
-		dataStorage := component.CreateDataStorage()
+// shutdown stops accepting connections and waits for the requests and
+// proxied connections in flight for at most config.ShutdownTimeout seconds.
+func shutdown(servers []*http.Server, tcpProxies []*handlers.TCPProxy, grpcServer *grpc.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.ShutdownTimeout)*time.Second)
+	defer cancel()
 
-		for key, value := range walletsAndServices.PublicKeys {
-			identificator := &cryptoutils.Identificator{
-				IdentificatorID:   key,
-				IdentificatorType: cryptoutils.IDENTIFICATOR_TYPE_WALLET,
-			}
+	for _, tcpProxy := range tcpProxies {
+		tcpProxy.Close()
+	}
 
-			err := cryptoStorage.AddIdentificator(identificator)
+	var wg sync.WaitGroup
 
-			if err != nil {
-				log.Println(err.Error())
-				time.Sleep(2 * time.Second)
-				continue
-			}
+	for _, srv := range servers {
+		wg.Add(1)
+
+		go func(srv *http.Server) {
+			defer wg.Done()
 
-			err = cryptoStorage.StorePublicKey(key, value)
+			err := srv.Shutdown(ctx)
 
 			if err != nil {
 				log.Println(err.Error())
-				time.Sleep(2 * time.Second)
-				continue
+				srv.Close()
 			}
+		}(srv)
+	}
 
-			err = cryptoStorage.AddIdentificatorToIdentificator(component.ProxyIdentificator, identificator)
+	wg.Add(1)
 
-			if err != nil {
-				log.Println(err.Error())
-				time.Sleep(2 * time.Second)
-				continue
-			}
+	go func() {
+		defer wg.Done()
 
-			err = cryptoStorage.AddIdentificatorToIdentificator(identificator, component.ProxyIdentificator)
+		stopped := make(chan struct{})
 
-			if err != nil {
-				log.Println(err.Error())
-				time.Sleep(2 * time.Second)
-				continue
-			}
+		go func() {
+			grpcServer.GracefulStop()
+			close(stopped)
+		}()
 
-			services, ok := walletsAndServices.Services[key]
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			grpcServer.Stop()
+		}
+	}()
 
-			if ok == false {
-				continue
-			}
+	wg.Add(1)
 
-			jsonData, err := json.Marshal(services)
+	go func() {
+		defer wg.Done()
 
-			if err != nil {
-				log.Println(err.Error())
-				time.Sleep(2 * time.Second)
-				continue
+		handlers.DrainConnections(ctx)
+	}()
+
+	wg.Wait()
+}
+
+func main() {
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+
+	err := component.LoadComponent()
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	healthChecksCtx, stopHealthChecks := context.WithCancel(ctx)
+	config.Routes.StartHealthChecks(healthChecksCtx)
+
+	maxBackoff := time.Duration(config.SyncMaxBackoff) * time.Second
+
+	walletsSync := handlers.NewIdentityProviderSync("wallets", handlers.SyncWallets, syncInterval, maxBackoff)
+
+	go walletsSync.Run(ctx)
+
+	tokenSync := handlers.NewTokenSync()
+
+	tokensSync := handlers.NewIdentityProviderSync("tokens", tokenSync.SyncIdentityProvider, syncInterval, maxBackoff)
+
+	go tokensSync.Run(ctx)
+
+	syncMonitor := handlers.NewSyncMonitor(walletsSync, tokensSync, tokenSync)
+
+	proxyHandler := handlers.NewHandle(config.Routes)
+	proxyHandler.SyncMonitor = syncMonitor
+
+	reloader := &routesReloader{
+		ctx:              ctx,
+		handle:           proxyHandler,
+		stopHealthChecks: stopHealthChecks,
+	}
+
+	go func() {
+		err := startReloadDaemon(ctx, reloader)
+
+		if err != nil {
+			log.Println(err.Error())
+		}
+	}()
+
+	var httpHandler http.Handler = proxyHandler
+
+	servers := []*http.Server{}
+	tcpProxies := []*handlers.TCPProxy{}
+
+	if config.ListenProxyTLSAddress != "" {
+		store, err := certificates.NewStore(config.Certificates)
+
+		if err != nil {
+			log.Println(err.Error())
+			return
+		}
+
+		tlsConfig := certificates.TLSConfig(store.GetCertificate)
+
+		if config.RedirectHTTP == true {
+			httpHandler = &handlers.RedirectToHTTPS{
+				TLSAddress: config.ListenProxyTLSAddress,
 			}
+		}
+
+		if config.ACMEEnabled == true {
+			manager, err := certificates.NewACMEManager(&certificates.StorageCache{
+				Storage: component.CreateDataStorage(),
+				Table:   component.ACME_CACHE,
+			})
 
-			err = dataStorage.SetKey(component.SERVICES, key, string(jsonData), config.TokenTTL*time.Second)
 			if err != nil {
 				log.Println(err.Error())
-				time.Sleep(2 * time.Second)
-				continue
+				return
 			}
-		}
 
-		time.Sleep(2 * time.Second)
-	}
-}
+			log.Println("ACME hosts: " + strings.Join(certificates.ACMEHosts(config.ProxyRules), ", "))
 
-func startActiveTokensDaemon() error {
-	for {
-		tokens, err := handlers.GetActiveTokensInternal()
+			tlsConfig = certificates.ACMETLSConfig(certificates.GetCertificate(store, manager))
+			httpHandler = manager.HTTPHandler(httpHandler)
+		}
+
+		tlsListener, err := graceful.Listen(config.ListenProxyTLSAddress)
 
 		if err != nil {
 			log.Println(err.Error())
-			time.Sleep(2 * time.Second)
-			continue
+			return
 		}
 
-		dataStorage := component.CreateDataStorage()
-
-		for key, value := range tokens {
-			for _, token := range value {
-				res, err := dataStorage.GetKey(component.TOKENS, key+"/"+token)
-
-				if err != nil {
-					log.Println(err.Error())
-					time.Sleep(2 * time.Second)
-					continue
-				}
-
-				if res == "" {
-					err = dataStorage.SetKey(component.TOKENS, key+"/"+token, token, config.TokenTTL*time.Second)
-					if err != nil {
-						log.Println(err.Error())
-						time.Sleep(2 * time.Second)
-						continue
-					}
-				}
-			}
+		tlsServer := &http.Server{
+			Handler:   proxyHandler,
+			TLSConfig: tlsConfig,
 		}
 
-		time.Sleep(2 * time.Second)
-	}
-}
+		servers = append(servers, tlsServer)
 
-func startProxyServer(bind string, rules map[string][]map[string]string) error {
-	srv := &http.Server{}
-
-	h := &handlers.Handle{
-		Rules:     rules,
-		TLSConfig: &tls.Config{InsecureSkipVerify: true},
-		Dialer: &net.Dialer{
-			Timeout:   30 * time.Second,
-			KeepAlive: 30 * time.Second,
-			DualStack: true,
-		},
-	}
+		go func() {
+			err := startProxyTLSServer(tlsServer, tlsListener)
 
-	log.Println("Binding to: " + bind)
+			if err != nil {
+				log.Println(err.Error())
+			}
+		}()
 
-	srv.Addr = bind
-	srv.Handler = h
-	if err := srv.ListenAndServe(); err != nil {
-		log.Println("ListenAndServe: " + err.Error())
-	}
+		go func() {
+			err := startCertificatesDaemon(ctx, store)
 
-	return nil
-}
+			if err != nil {
+				log.Println(err.Error())
+			}
+		}()
+	}
 
-func startFail2BanDeamon() error {
-	for {
-		fail2banDataStorage := component.CreateFail2BanDataStorage()
+	for _, tcpProxyRule := range config.TCPProxies {
+		tcpProxy := &handlers.TCPProxy{
+			Rule:        tcpProxyRule,
+			Dialer:      config.Routes.Dialer,
+			SyncMonitor: syncMonitor,
+		}
 
-		err := utils.LogBannedIPs(fail2banDataStorage)
+		tcpListener, err := graceful.Listen(tcpProxyRule.Listen)
 
 		if err != nil {
 			log.Println(err.Error())
-			return err
+			return
 		}
 
-		time.Sleep(2 * time.Second)
+		tcpProxies = append(tcpProxies, tcpProxy)
+
+		go func() {
+			err := tcpProxy.Serve(tcpListener)
+
+			if err != nil {
+				log.Println(err.Error())
+			}
+		}()
+	}
+
+	if config.H2C == true {
+		httpHandler = h2c.NewHandler(httpHandler, &http2.Server{})
 	}
 
-	return nil
-}
+	listener, err := graceful.Listen(config.ListenProxyAddress)
 
-func main() {
-	err := component.LoadComponent()
 	if err != nil {
 		log.Println(err.Error())
 		return
 	}
 
+	proxyServer := &http.Server{
+		Handler: httpHandler,
+	}
+
+	servers = append(servers, proxyServer)
+
 	go func() {
-		err := startWalletsAndServicesDaemon()
+		err := startProxyServer(proxyServer, listener)
 
 		if err != nil {
 			log.Println(err.Error())
 		}
 	}()
 
-	go func() {
-		err := startActiveTokensDaemon()
+	if config.ListenPushAddress != "" {
+		pushListener, err := graceful.Listen(config.ListenPushAddress)
 
 		if err != nil {
 			log.Println(err.Error())
+			return
 		}
-	}()
+
+		pushServer := &http.Server{
+			Handler: &handlers.PushHandler{
+				TokenSync: tokenSync,
+			},
+		}
+
+		servers = append(servers, pushServer)
+
+		go func() {
+			err := startPushServer(pushServer, pushListener)
+
+			if err != nil {
+				log.Println(err.Error())
+			}
+		}()
+	}
 
 	go func() {
-		err := startProxyServer(config.ListenProxyAddress, config.ProxyRules)
+		err := startFail2BanDeamon(ctx)
 
 		if err != nil {
 			log.Println(err.Error())
 		}
 	}()
 
+	// create a listener on TCP port
+	grpcListener, err := graceful.Listen(config.ListenGRPCAddress)
+
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+
+	graceful.CloseInherited()
+
+	grpcServer := newGRPCServer(syncMonitor)
+
 	go func() {
-		err := startFail2BanDeamon()
+		log.Println("Starting grpc server")
+
+		err := startGRPCServer(grpcServer, grpcListener)
 
 		if err != nil {
 			log.Println(err.Error())
 		}
 	}()
 
-	log.Println("Starting grpc server")
-	err = startGRPCServer(config.ListenGRPCAddress)
+	graceful.Ready()
+
+	waitForShutdown()
+
+	log.Println("Shutting down")
+
+	cancel()
+	shutdown(servers, tcpProxies, grpcServer)
+
+	log.Println("Stopped")
 }